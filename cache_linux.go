@@ -0,0 +1,67 @@
+package pcapper
+
+// bufferCache holds the buffers by key. *lru.Cache implements it, as does
+// mapCache for Opts.NoEviction.
+type bufferCache interface {
+	Add(key, value interface{}) bool
+	Get(key interface{}) (interface{}, bool)
+	Peek(key interface{}) (interface{}, bool)
+	Remove(key interface{}) bool
+	Keys() []interface{}
+	Len() int
+	Purge()
+}
+
+// mapCache is a bufferCache that never evicts anything. Like *lru.Cache, it
+// calls onEvict for entries that are removed or purged.
+type mapCache struct {
+	entries map[interface{}]interface{}
+	onEvict func(key interface{}, value interface{})
+}
+
+func newMapCache(onEvict func(key interface{}, value interface{})) *mapCache {
+	return &mapCache{entries: make(map[interface{}]interface{}), onEvict: onEvict}
+}
+
+func (m *mapCache) Add(key, value interface{}) bool {
+	m.entries[key] = value
+	return false
+}
+
+func (m *mapCache) Get(key interface{}) (interface{}, bool) {
+	value, found := m.entries[key]
+	return value, found
+}
+
+func (m *mapCache) Peek(key interface{}) (interface{}, bool) {
+	return m.Get(key)
+}
+
+func (m *mapCache) Remove(key interface{}) bool {
+	value, found := m.entries[key]
+	if found {
+		delete(m.entries, key)
+		m.onEvict(key, value)
+	}
+	return found
+}
+
+// Keys returns the keys in no particular order.
+func (m *mapCache) Keys() []interface{} {
+	keys := make([]interface{}, 0, len(m.entries))
+	for key := range m.entries {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+func (m *mapCache) Len() int {
+	return len(m.entries)
+}
+
+func (m *mapCache) Purge() {
+	for key, value := range m.entries {
+		delete(m.entries, key)
+		m.onEvict(key, value)
+	}
+}
@@ -0,0 +1,1050 @@
+package pcapper
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+	"github.com/google/gopacket/pcapgo"
+	"github.com/hashicorp/golang-lru"
+)
+
+// heartbeatInterval is how often the capture loop shows that it's alive when
+// there's nothing else to do (see Healthy).
+const heartbeatInterval = time.Second
+
+// packetOverhead estimates the bytes that a buffered packet takes up besides its
+// data: gopacket's packet and decoded layers, and its slot in the ring.
+const packetOverhead = 640
+
+// pairSeparator joins the two IPs of a key with Opts.KeyByPair.
+const pairSeparator = "_"
+
+// capturer holds the state of a running capture. Apart from where noted, its
+// fields are only accessed from the capture goroutine (see run).
+type capturer struct {
+	opts            *Opts
+	clock           Clock
+	sources         []*source
+	linkType        layers.LinkType // shared by all sources, fixed once capture starts
+	status          Status
+	localInterfaces map[string]bool
+	buffersByIP     bufferCache
+	allowedNets     []*net.IPNet
+	etherTypes      map[layers.EthernetType]bool
+	excludedPorts   map[uint16]bool
+	rolling         bool
+	snapLen         int // Opts.SnapLen, or derived from the MTU with Opts.AutoSnapLen
+	triggerDebounce time.Duration
+	rules           []*pcap.BPF
+	aead            cipher.AEAD // nil unless encrypting dumps
+	catchAllKey     string
+
+	// packets and readErrors are fed by the reader goroutine (see
+	// startReading), reopened by reopen.
+	packets    chan gopacket.Packet
+	readErrors chan *readError
+	reopened   chan *reopenedSource
+
+	doDumpRequests chan *dumpRequest
+	// dumpJobs feeds the dump workers, which write files off the capture
+	// goroutine so that slow disks don't stall capture.
+	dumpJobs    chan *dumpJob
+	fileSlots   *semaphore
+	workers     sync.WaitGroup
+	dispatchers sync.WaitGroup
+	// background counts the other goroutines that exit once done is closed:
+	// readers, reopens and delayed dumps
+	background sync.WaitGroup
+	// done is closed once capture has stopped
+	done   chan struct{}
+	mirror *mirror // nil unless Opts.Mirror is set
+
+	subscriptions []*subscription
+
+	// lastDumped holds the time of the last dump by buffer IP
+	lastDumped *lru.Cache
+
+	// disabled holds the keys, or with Opts.KeyByPair also single IPs, that
+	// aren't buffered (see DisableIP)
+	disabled map[string]bool
+
+	// flows holds the flows seen with Opts.FirstPacketPerFlow, by flowKey
+	flows *lru.Cache
+
+	packetsSeen      int
+	packetsKept      int
+	packetsMalformed int
+	packetsBySize    int   // filtered by size
+	dumpsSkipped     int   // because of MinDumpInterval
+	packetsFiltered  int64 // written by the reader goroutine
+
+	dumpWait    DurationHistogram
+	dumpWrite   DurationHistogram // written by the dump workers
+	dumpWriteMx sync.Mutex
+
+	// recentDumps holds the latest results for RecentDumps, oldest first.
+	// Like dumpWrite, it's written by the dump workers.
+	recentDumps   []*DumpResult
+	recentDumpsMx sync.Mutex
+}
+
+// newCapturer sets up capture with opts, from handle if it's not nil and from
+// the interfaces in opts otherwise.
+func newCapturer(opts *Opts, handle packetSource) (*capturer, error) {
+	if opts.NumIPs < 1 && !opts.NoEviction {
+		return nil, log.Errorf("Invalid number of IPs %v, must be at least 1", opts.NumIPs)
+	}
+	if opts.PacketsPerIP < 1 && opts.RollingFileSize <= 0 {
+		return nil, log.Errorf("Invalid number of packets per IP %v, must be at least 1", opts.PacketsPerIP)
+	}
+	numIPs := opts.NumIPs
+	if numIPs < 1 {
+		// Without eviction, NumIPs may be left unset
+		numIPs = DefaultNumIPs
+	}
+	c := &capturer{
+		opts:            opts,
+		clock:           opts.Clock,
+		rolling:         opts.RollingFileSize > 0,
+		snapLen:         opts.SnapLen,
+		triggerDebounce: opts.TriggerDebounce,
+		packets:         make(chan gopacket.Packet),
+		readErrors:      make(chan *readError),
+		reopened:        make(chan *reopenedSource),
+		doDumpRequests:  make(chan *dumpRequest, numIPs),
+		dumpJobs:        make(chan *dumpJob, numIPs),
+		fileSlots:       newSemaphore(opts.MaxOpenDumpFiles),
+		done:            make(chan struct{}),
+	}
+	if c.triggerDebounce <= 0 {
+		c.triggerDebounce = DefaultTriggerDebounce
+	}
+	if c.clock == nil {
+		c.clock = realClock{}
+	}
+	c.catchAllKey = opts.CatchAllKey
+	if c.catchAllKey == "" && opts.MonitorMode {
+		c.catchAllKey = DefaultCatchAllKey
+	}
+	if opts.InMemory && c.rolling {
+		return nil, log.Error("Unable to capture to rolling files in memory-only mode")
+	}
+	if len(opts.EncryptionKey) > 0 {
+		if c.rolling {
+			return nil, log.Error("Unable to encrypt rolling files")
+		}
+		if opts.DumpFormat == DumpFormatFlows {
+			return nil, log.Error("Unable to encrypt flow logs")
+		}
+		var err error
+		c.aead, err = newAEAD(opts.EncryptionKey)
+		if err != nil {
+			return nil, log.Errorf("Invalid encryption key: %v", err)
+		}
+	}
+
+	ifAddrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil, log.Errorf("Unable to determine interface addresses: %v", err)
+	}
+	c.localInterfaces = make(map[string]bool, len(ifAddrs))
+	for _, ifAddr := range ifAddrs {
+		addr := strings.Split(ifAddr.String(), "/")[0] // get rid of CIDR routing prefix
+		log.Debugf("Will not save packets for local interface %v", addr)
+		c.localInterfaces[addr] = true
+	}
+
+	for _, allowed := range opts.AllowedIPs {
+		network, err := parseNetwork(allowed)
+		if err != nil {
+			return nil, log.Errorf("Invalid allowed IP %v: %v", allowed, err)
+		}
+		c.allowedNets = append(c.allowedNets, network)
+	}
+
+	if len(opts.EtherTypes) > 0 {
+		c.etherTypes = make(map[layers.EthernetType]bool, len(opts.EtherTypes))
+		for _, t := range opts.EtherTypes {
+			c.etherTypes[t] = true
+		}
+	}
+	if len(opts.ExcludeLocalPorts) > 0 {
+		c.excludedPorts = make(map[uint16]bool, len(opts.ExcludeLocalPorts))
+		for _, port := range opts.ExcludeLocalPorts {
+			c.excludedPorts[port] = true
+		}
+	}
+
+	onEvict := func(key interface{}, value interface{}) {
+		if rf, ok := value.(*rollingFile); ok {
+			rf.close()
+		}
+	}
+	if opts.NoEviction {
+		if len(c.allowedNets) == 0 {
+			log.Debug("Keeping buffers for all IPs without eviction, memory use is unbounded")
+		}
+		c.buffersByIP = newMapCache(onEvict)
+	} else {
+		c.buffersByIP, err = lru.NewWithEvict(opts.NumIPs, onEvict)
+		if err != nil {
+			return nil, log.Errorf("Unable to initialize cache: %v", err)
+		}
+	}
+
+	// Remembers as many IPs as there are buffers, which covers those whose
+	// dumps could be repeated soon
+	c.lastDumped, err = lru.New(numIPs)
+	if err != nil {
+		return nil, log.Errorf("Unable to initialize cache: %v", err)
+	}
+	if opts.FirstPacketPerFlow {
+		size := opts.FlowTableSize
+		if size <= 0 {
+			size = DefaultFlowTableSize
+		}
+		c.flows, err = lru.New(size)
+		if err != nil {
+			return nil, log.Errorf("Unable to initialize flow table: %v", err)
+		}
+	}
+
+	if handle == nil {
+		c.checkSnapLen()
+	}
+	if err := c.openSources(handle); err != nil {
+		return nil, err
+	}
+	for _, src := range c.sources {
+		if opts.VLANTags == VLANTagsKeep {
+			src.vlanID = opts.VLANID
+			if src.vlanID == 0 {
+				src.vlanID = vlanFromInterfaceName(src.name)
+			}
+			if src.vlanID == 0 || src.vlanID > 4094 {
+				c.closeSources()
+				return nil, log.Errorf("Keeping VLAN tags needs a VLAN id between 1 and 4094, but got %d for %v", src.vlanID, src.name)
+			}
+		}
+	}
+	// Rules are compiled for the packets as we keep them, which may have a fake
+	// Ethernet header. All sources share a link type, so they work for each.
+	ruleSnapLen := c.snapLen
+	if c.linkType != c.sources[0].handle.LinkType() {
+		ruleSnapLen += 14
+	}
+	for _, rule := range opts.Rules {
+		bpf, err := pcap.NewBPF(c.linkType, ruleSnapLen, rule.Filter)
+		if err != nil {
+			c.closeSources()
+			return nil, log.Errorf("Unable to compile filter %v for rule %v: %v", rule.Filter, rule.Name, err)
+		}
+		c.rules = append(c.rules, bpf)
+	}
+	// Dir itself is up to the caller, but the directories in it for rules and
+	// interfaces are created here
+	for rule := 0; rule <= len(c.rules) && !opts.InMemory; rule++ {
+		for iface := range c.sources {
+			dir := c.dirFor(bufferKey{rule: rule, iface: iface})
+			if dir == c.opts.Dir {
+				continue
+			}
+			if err := os.MkdirAll(dir, 0755); err != nil {
+				c.closeSources()
+				return nil, log.Errorf("Unable to create directory %v: %v", dir, err)
+			}
+		}
+	}
+	return c, nil
+}
+
+// run is the capture goroutine. It exclusively owns the buffers.
+func (c *capturer) run() {
+	numWorkers := c.opts.DumpWorkers
+	if numWorkers <= 0 {
+		numWorkers = DefaultDumpWorkers
+	}
+	c.workers.Add(numWorkers)
+	for i := 0; i < numWorkers; i++ {
+		go c.dumpWorker()
+	}
+
+	c.mirror = c.startMirror()
+	for _, src := range c.sources {
+		c.startReading(src)
+	}
+	c.setStatus(StatusCapturing)
+
+	// Stats are also polled for drop alerts, which may be registered at any
+	// time
+	statsInterval := c.opts.StatsInterval
+	if statsInterval <= 0 {
+		statsInterval = DefaultDropAlertInterval
+	}
+	statsTicker := time.NewTicker(statsInterval)
+	defer statsTicker.Stop()
+	heartbeat := time.NewTicker(heartbeatInterval)
+	defer heartbeat.Stop()
+	var expired <-chan time.Time
+	if c.opts.MaxDuration > 0 {
+		expired = c.clock.After(c.opts.MaxDuration)
+	}
+
+	for {
+		select {
+		case packet := <-c.packets:
+			c.handlePacket(packet)
+		case err := <-c.readErrors:
+			c.readFailed(err)
+		case handle := <-c.reopened:
+			c.reopenedHandle(handle)
+		case dr := <-dumpRequests:
+			c.afterCaptureDelay(dr)
+		case comment := <-dumpAllRequests:
+			c.afterCaptureDelay(&dumpRequest{all: true, comment: comment})
+		case dr := <-c.doDumpRequests:
+			c.dumpWait.observe(c.clock.Now().Sub(dr.requested) - dr.delay)
+			if dr.all {
+				c.dumpAll(dr.comment, false)
+			} else if dr.match {
+				c.dumpMatching(dr.ip, dr.comment)
+			} else {
+				c.dumpIP(dr.ip, dr.comment, dr.keep)
+			}
+		case task := <-tasks:
+			task(c)
+		case <-heartbeat.C:
+			// Nothing to do but show that we're alive
+		case <-statsTicker.C:
+			c.pollStats()
+		case <-expired:
+			log.Debugf("Captured for %v, stopping", c.opts.MaxDuration)
+			if err := c.finish(c.opts.DrainAfterMaxDuration, ""); err != nil {
+				// Nobody is waiting for the result
+				reportError(err)
+			}
+			return
+		case sr := <-stopRequests:
+			sr.result <- c.finish(sr.dumpAll, sr.comment)
+			return
+		}
+		c.touch()
+	}
+}
+
+// touch records that the capture loop is alive (see Healthy).
+func (c *capturer) touch() {
+	atomic.StoreInt64(&lastActivity, time.Now().UnixNano())
+}
+
+// finish stops capturing, first dumping all buffers with the given comment if
+// dumpAll is true. It returns the first error that dumping encountered.
+func (c *capturer) finish(dumpAll bool, comment string) error {
+	var err error
+	if dumpAll {
+		// Wait a little bit to make sure we capture the relevant packets
+		<-c.clock.After(c.opts.Timeout * 2)
+		err = c.dumpAll(comment, true)
+	}
+	c.stop()
+	return err
+}
+
+// handlePacket processes a packet read from the interface.
+func (c *capturer) handlePacket(packet gopacket.Packet) {
+	c.packetsSeen++
+	if c.opts.DropMalformed && packet.ErrorLayer() != nil {
+		c.packetsMalformed++
+		return
+	}
+	if c.opts.ICMPOnly && packet.Layer(layers.LayerTypeICMPv4) == nil && packet.Layer(layers.LayerTypeICMPv6) == nil {
+		return
+	}
+	if c.opts.TCPFlags != 0 {
+		if tcp, ok := packet.Layer(layers.LayerTypeTCP).(*layers.TCP); !ok || tcpFlags(tcp)&c.opts.TCPFlags == 0 {
+			return
+		}
+	}
+	// Fragments always carry their IP header, even when they lack a transport
+	// header, so all fragments of a datagram end up in the same buffer. They
+	// are kept as captured rather than reassembled, so that dumps show exactly
+	// what was on the wire.
+	//
+	// IPv6 extension headers, such as hop-by-hop options, routing and fragment
+	// headers, are decoded as layers of their own after the IPv6 layer, which
+	// stays the network layer, so such packets are keyed on the addresses of
+	// the IPv6 header like any other. With a routing header, that's the
+	// destination of the current hop rather than the final one.
+	nl := c.networkLayer(packet)
+	switch t := nl.(type) {
+	case *layers.IPv4:
+		c.capturePacket(t.DstIP, t.SrcIP, packet)
+	case *layers.IPv6:
+		c.capturePacket(t.DstIP, t.SrcIP, packet)
+	default:
+		if c.catchAllKey != "" {
+			c.captureCatchAll(packet)
+		}
+	}
+}
+
+// networkLayer returns the network layer on whose addresses packet is keyed,
+// which is the inner one of GTP-U packets with Opts.DecapsulateGTPU.
+func (c *capturer) networkLayer(packet gopacket.Packet) gopacket.NetworkLayer {
+	if c.opts.DecapsulateGTPU {
+		if nl := gtpInnerLayer(packet); nl != nil {
+			return nl
+		}
+	}
+	return packet.NetworkLayer()
+}
+
+// captureCatchAll buffers a packet without an IP layer under the catch-all key
+// (see Opts.CatchAllKey).
+func (c *capturer) captureCatchAll(packet gopacket.Packet) {
+	if !c.store(bufferKey{ip: c.catchAllKey, iface: c.interfaceOf(packet)}, packet) {
+		return
+	}
+	c.kept(packet)
+	if len(c.subscriptions) > 0 {
+		c.publish([]string{c.catchAllKey}, packet)
+	}
+	fireTriggers([]string{c.catchAllKey}, packet, c.clock.Now(), c.triggerDebounce)
+}
+
+// kept accounts for a packet that was buffered and passes it on to OnPacket and
+// the mirror.
+func (c *capturer) kept(packet gopacket.Packet) {
+	c.packetsKept++
+	if c.opts.OnPacket != nil {
+		c.opts.OnPacket(packet)
+	}
+	if c.mirror != nil {
+		c.mirror.add(c.captureData(packet))
+	}
+}
+
+func (c *capturer) stats() *Stats {
+	c.dumpWriteMx.Lock()
+	dumpWrite := c.dumpWrite.copy()
+	c.dumpWriteMx.Unlock()
+	stats := &Stats{
+		BufferSize:            c.opts.BufferSize,
+		PacketsSeen:           c.packetsSeen,
+		PacketsKept:           c.packetsKept,
+		PacketsMalformed:      c.packetsMalformed,
+		PacketsFiltered:       int(atomic.LoadInt64(&c.packetsFiltered)),
+		PacketsFilteredBySize: c.packetsBySize,
+		DumpsSkipped:          c.dumpsSkipped,
+		ActiveIPs:             c.buffersByIP.Len(),
+		DumpWait:              c.dumpWait.copy(),
+		DumpWrite:             dumpWrite,
+	}
+	if c.mirror != nil {
+		stats.PacketsMirrorDropped = int(atomic.LoadInt64(&c.mirror.dropped))
+	}
+	if c.flows != nil {
+		stats.FlowsTracked = c.flows.Len()
+	}
+	if !c.rolling {
+		// Keys are oldest first
+		keys := c.buffersByIP.Keys()
+		for i := len(keys) - 1; i >= 0; i-- {
+			if bs := c.bufferStats(keys[i].(bufferKey)); bs != nil {
+				stats.Buffers = append(stats.Buffers, bs)
+			}
+		}
+	}
+	for _, src := range c.sources {
+		// A nil handle is reopening, pcap's counters went with the old one.
+		// Sources other than pcap handles have no counters.
+		handle, ok := src.handle.(*pcap.Handle)
+		if !ok {
+			continue
+		}
+		handleStats, err := handle.Stats()
+		if err != nil {
+			log.Debugf("Unable to get pcap stats for %v: %v", src.name, err)
+			continue
+		}
+		stats.PacketsReceived += handleStats.PacketsReceived
+		stats.PacketsDropped += handleStats.PacketsDropped
+		stats.PacketsIfDropped += handleStats.PacketsIfDropped
+	}
+	return stats
+}
+
+func (c *capturer) bufferStats(key bufferKey) *BufferStats {
+	_buffer, found := c.buffersByIP.Peek(key)
+	if !found {
+		return nil
+	}
+	bs := &BufferStats{IP: key.ip, VLAN: key.vlan}
+	if key.rule > 0 {
+		bs.Rule = c.opts.Rules[key.rule-1].Name
+	}
+	if c.opts.SeparateInterfaces {
+		bs.Interface = c.sources[key.iface].name
+	}
+	_buffer.(*packetRing).forEach(func(packet gopacket.Packet) bool {
+		timestamp := packet.Metadata().Timestamp
+		if bs.Packets == 0 {
+			bs.FirstSeen = timestamp
+		}
+		bs.LastSeen = timestamp
+		bs.Packets++
+		return true
+	})
+	return bs
+}
+
+// memoryUsage implements MemoryUsage.
+func (c *capturer) memoryUsage() int64 {
+	var usage int64
+	// A packet to or from two buffered IPs, or kept for several rules, is
+	// in several buffers
+	seen := make(map[gopacket.Packet]bool)
+	for _, key := range c.buffersByIP.Keys() {
+		_buffer, found := c.buffersByIP.Peek(key)
+		if !found {
+			continue
+		}
+		_buffer.(*packetRing).forEach(func(packet gopacket.Packet) bool {
+			if !seen[packet] {
+				seen[packet] = true
+				usage += int64(len(packet.Data())) + packetOverhead
+			}
+			return true
+		})
+	}
+	return usage
+}
+
+// pollStats reports stats if Opts.StatsInterval is set and evaluates the drop
+// alerts.
+func (c *capturer) pollStats() {
+	var stats *Stats
+	if c.opts.StatsInterval > 0 {
+		stats = c.stats()
+		c.reportStats(stats)
+	}
+	if hasDropAlerts() {
+		if stats == nil {
+			stats = c.stats()
+		}
+		checkDropAlerts(stats)
+	}
+}
+
+func (c *capturer) reportStats(stats *Stats) {
+	if c.opts.OnStats != nil {
+		c.opts.OnStats(stats)
+		return
+	}
+	log.Debugf("Seen %d packets, kept %d for %d IPs, pcap dropped %d (interface dropped %d)",
+		stats.PacketsSeen, stats.PacketsKept, stats.ActiveIPs, stats.PacketsDropped, stats.PacketsIfDropped)
+}
+
+// afterCaptureDelay passes dr back to the capture goroutine once enough time
+// has passed for the packets relevant to it to have been captured, including
+// those of its delay. Unlike sleeping, this doesn't hold up capture in the
+// meantime.
+func (c *capturer) afterCaptureDelay(dr *dumpRequest) {
+	dr.requested = c.clock.Now()
+	after := c.clock.After(dr.delay + c.opts.Timeout*2)
+	c.background.Add(1)
+	go func() {
+		defer c.background.Done()
+		select {
+		case <-after:
+		case <-c.done:
+			return
+		}
+		select {
+		case c.doDumpRequests <- dr:
+		case <-c.done:
+		}
+	}()
+}
+
+func (c *capturer) stop() {
+	// Let the workers finish the dumps that have already been requested
+	c.dispatchers.Wait()
+	close(c.dumpJobs)
+	c.workers.Wait()
+	c.closeSources()
+	if c.rolling {
+		// Closes all rolling files via the eviction callback
+		c.buffersByIP.Purge()
+	}
+	if c.mirror != nil {
+		c.mirror.close()
+	}
+	c.closeSubscriptions()
+	// Readers exit as their handles were closed, the others as soon as they
+	// see done, so none of our goroutines outlive Stop
+	close(c.done)
+	c.background.Wait()
+	c.setStatus(StatusStopped)
+	log.Debug("Stopped capturing")
+}
+
+func (c *capturer) getBuffer(key bufferKey) *packetRing {
+	_buffer, found := c.buffersByIP.Get(key)
+	if !found {
+		_buffer = newPacketRing(c.packetsPerIP(key), c.opts.BufferDuration)
+		c.buffersByIP.Add(key, _buffer)
+	}
+	return _buffer.(*packetRing)
+}
+
+// packetsPerIP returns the capacity of the buffer for key.
+func (c *capturer) packetsPerIP(key bufferKey) int {
+	if key.rule > 0 {
+		if packetsPerIP := c.opts.Rules[key.rule-1].PacketsPerIP; packetsPerIP > 0 {
+			return packetsPerIP
+		}
+	}
+	return c.opts.PacketsPerIP
+}
+
+// keyIP returns the string under which packets for ip are buffered. That's
+// normally just the IP, str, but with IPv4PrefixLen or IPv6PrefixLen it's the
+// network containing ip, in CIDR notation.
+func (c *capturer) keyIP(ip net.IP, str string) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		if c.opts.IPv4PrefixLen > 0 && c.opts.IPv4PrefixLen < 32 {
+			mask := net.CIDRMask(c.opts.IPv4PrefixLen, 32)
+			return (&net.IPNet{IP: ip4.Mask(mask), Mask: mask}).String()
+		}
+		return str
+	}
+	if c.opts.IPv6PrefixLen > 0 && c.opts.IPv6PrefixLen < 128 {
+		mask := net.CIDRMask(c.opts.IPv6PrefixLen, 128)
+		return (&net.IPNet{IP: ip.Mask(mask), Mask: mask}).String()
+	}
+	return str
+}
+
+// keysFor returns the keys of the buffers for ip. ip may also be a network in
+// CIDR notation, as used in keys when masking with IPv4PrefixLen or
+// IPv6PrefixLen. With Opts.KeyByPair, the buffers for ip are those of all the
+// pairs it's part of, and ip may also be a pair, as in <ipA>_<ipB>.
+func (c *capturer) keysFor(ip string) []bufferKey {
+	ip = c.keyString(ip)
+	if !c.opts.KeyByVLAN && len(c.rules) == 0 && !c.opts.KeyByPair && !c.opts.SeparateInterfaces {
+		return []bufferKey{{ip: ip}}
+	}
+	// The IP's traffic may have been seen on any number of VLANs, rules,
+	// pairs and interfaces
+	var keys []bufferKey
+	for _, key := range c.buffersByIP.Keys() {
+		if c.keyMatches(key.(bufferKey).ip, ip) {
+			keys = append(keys, key.(bufferKey))
+		}
+	}
+	return keys
+}
+
+// keyString returns the key under which packets for ip, given as a string, are
+// buffered, which for anything but an IP is ip itself (see keyIP).
+func (c *capturer) keyString(ip string) string {
+	if parsed := net.ParseIP(ip); parsed != nil {
+		return c.keyIP(parsed, ip)
+	}
+	return ip
+}
+
+// keyMatches reports whether the key of a buffer, keyIP, belongs to ip.
+func (c *capturer) keyMatches(keyIP string, ip string) bool {
+	if keyIP == ip {
+		return true
+	}
+	if !c.opts.KeyByPair {
+		return false
+	}
+	return strings.HasPrefix(keyIP, ip+pairSeparator) || strings.HasSuffix(keyIP, pairSeparator+ip)
+}
+
+func (c *capturer) has(ip string) bool {
+	for _, key := range c.keysFor(ip) {
+		_buffer, found := c.buffersByIP.Peek(key)
+		if !found {
+			continue
+		}
+		if c.rolling || _buffer.(*packetRing).len() > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// interfaceOf returns the index of the source of packet for its key (see
+// bufferKey).
+func (c *capturer) interfaceOf(packet gopacket.Packet) int {
+	if !c.opts.SeparateInterfaces {
+		return 0
+	}
+	// Injected packets may claim any interface
+	if index := packet.Metadata().InterfaceIndex; index > 0 && index < len(c.sources) {
+		return index
+	}
+	return 0
+}
+
+// interfaceFor returns the name of the interface recorded in the files for
+// key.
+func (c *capturer) interfaceFor(key bufferKey) string {
+	if c.opts.SeparateInterfaces {
+		return c.sources[key.iface].name
+	}
+	return c.interfaceNames()
+}
+
+// dirFor returns the directory into which the buffer for key is dumped.
+func (c *capturer) dirFor(key bufferKey) string {
+	dir := c.baseDirFor(key)
+	if key.rule > 0 && c.opts.Rules[key.rule-1].Dir == "" {
+		dir = filepath.Join(dir, c.opts.Rules[key.rule-1].Name)
+	}
+	if c.opts.SeparateInterfaces {
+		dir = filepath.Join(dir, c.sources[key.iface].name)
+	}
+	return dir
+}
+
+// baseDirFor returns the directory that the files of the buffer for key are
+// under, which is Opts.Dir unless key's rule has a Dir of its own.
+func (c *capturer) baseDirFor(key bufferKey) string {
+	if key.rule > 0 {
+		if dir := c.opts.Rules[key.rule-1].Dir; dir != "" {
+			return dir
+		}
+	}
+	return c.opts.Dir
+}
+
+func (c *capturer) getRollingFile(key bufferKey) (*rollingFile, error) {
+	_rf, found := c.buffersByIP.Get(key)
+	if found {
+		return _rf.(*rollingFile), nil
+	}
+	rf, err := openRollingFile(filepath.Join(c.dirFor(key), key.fileName()), c.opts.RollingFileSize, c.checkExisting, func(w io.Writer, snapLen uint32) (*pcapgo.NgWriter, error) {
+		return c.newPcapWriter(w, c.interfaceFor(key), "", snapLen)
+	})
+	if err != nil {
+		return nil, err
+	}
+	c.buffersByIP.Add(key, rf)
+	return rf, nil
+}
+
+// isDisabled reports whether buffering under key is disabled by DisableIP,
+// which for a pair also applies when either of its IPs is disabled.
+func (c *capturer) isDisabled(key string) bool {
+	if c.disabled[key] {
+		return true
+	}
+	if !c.opts.KeyByPair {
+		return false
+	}
+	if sep := strings.Index(key, pairSeparator); sep >= 0 {
+		return c.disabled[key[:sep]] || c.disabled[key[sep+len(pairSeparator):]]
+	}
+	return false
+}
+
+// seenFlow reports whether packet belongs to a flow that was seen before, and
+// remembers its flow otherwise (see Opts.FirstPacketPerFlow).
+func (c *capturer) seenFlow(packet gopacket.Packet) bool {
+	key, ok := flowKeyOf(packet)
+	if !ok {
+		return false
+	}
+	// Get rather than Contains, so that active flows are remembered longest
+	if _, found := c.flows.Get(key); found {
+		return true
+	}
+	c.flows.Add(key, nil)
+	return false
+}
+
+// excludedLocalPort reports whether packet is TCP or UDP with a port in
+// Opts.ExcludeLocalPorts on its local side.
+func (c *capturer) excludedLocalPort(dstIP string, srcIP string, packet gopacket.Packet) bool {
+	var dstPort, srcPort uint16
+	switch t := packet.TransportLayer().(type) {
+	case *layers.TCP:
+		dstPort, srcPort = uint16(t.DstPort), uint16(t.SrcPort)
+	case *layers.UDP:
+		dstPort, srcPort = uint16(t.DstPort), uint16(t.SrcPort)
+	default:
+		return false
+	}
+	return (c.localInterfaces[dstIP] && c.excludedPorts[dstPort]) ||
+		(c.localInterfaces[srcIP] && c.excludedPorts[srcPort])
+}
+
+func (c *capturer) capturePacket(dst net.IP, src net.IP, packet gopacket.Packet) {
+	if length := packet.Metadata().Length; (c.opts.MinPacketSize > 0 && length < c.opts.MinPacketSize) ||
+		(c.opts.MaxPacketSize > 0 && length > c.opts.MaxPacketSize) {
+		c.packetsBySize++
+		return
+	}
+	dstIP, srcIP := dst.String(), src.String()
+	if c.excludedPorts != nil && c.excludedLocalPort(dstIP, srcIP, packet) {
+		return
+	}
+	var vlan uint16
+	if c.opts.KeyByVLAN {
+		// gopacket decodes 802.1Q tags before the network layer, so tagged
+		// frames reach here like any other. For QinQ, the first (outer) tag
+		// wins.
+		if dot1q, ok := packet.Layer(layers.LayerTypeDot1Q).(*layers.Dot1Q); ok {
+			vlan = dot1q.VLANIdentifier
+		}
+	}
+	// Packets are kept under the remote side of the conversation. If neither
+	// side is local (tap or mirror port), that's the destination, plus the
+	// source if KeyBothEndpoints is set. If both sides are local, the packet
+	// isn't kept at all.
+	var ipsArray [2]string
+	ips := ipsArray[:0]
+	if c.opts.KeyFunc != nil {
+		ips = c.opts.KeyFunc(dst, src, packet)
+	} else if c.opts.KeyByPair {
+		// Both directions go under the one key for the pair
+		if (!c.localInterfaces[dstIP] || !c.localInterfaces[srcIP]) && (c.allowed(dst) || c.allowed(src)) {
+			ips = append(ips, c.pairKey(dst, src))
+		}
+	} else if !c.localInterfaces[dstIP] {
+		ips = c.appendKey(ips, dst, dstIP)
+		if c.opts.KeyBothEndpoints && !c.localInterfaces[srcIP] {
+			ips = c.appendKey(ips, src, srcIP)
+		}
+	} else if !c.localInterfaces[srcIP] {
+		ips = c.appendKey(ips, src, srcIP)
+	}
+
+	if len(c.disabled) > 0 {
+		enabled := ips[:0]
+		for _, ip := range ips {
+			if !c.isDisabled(ip) {
+				enabled = append(enabled, ip)
+			}
+		}
+		ips = enabled
+	}
+	if len(ips) == 0 {
+		return
+	}
+	if c.flows != nil && c.seenFlow(packet) {
+		return
+	}
+
+	iface := c.interfaceOf(packet)
+	stored := packet
+	if c.opts.BufferHeadersOnly {
+		stored = c.headersOnly(packet)
+	}
+	kept := false
+	keep := func(rule int) {
+		for _, ip := range ips {
+			if c.store(bufferKey{ip, vlan, rule, iface}, stored) {
+				kept = true
+			}
+		}
+	}
+	matchedRule := false
+	if len(c.rules) > 0 {
+		ci := packet.Metadata().CaptureInfo
+		for i, bpf := range c.rules {
+			if bpf.Matches(ci, packet.Data()) {
+				matchedRule = true
+				keep(i + 1)
+			}
+		}
+	}
+	if !matchedRule {
+		keep(0)
+	}
+	if !kept {
+		return
+	}
+	c.kept(packet)
+	if len(c.subscriptions) > 0 {
+		c.publish(ips, packet)
+	}
+	fireTriggers(ips, packet, c.clock.Now(), c.triggerDebounce)
+}
+
+// headersOnly returns a completely decoded packet with only the headers of
+// packet (see headerLength) and its metadata, marked as truncated if that cut
+// anything off. The headers are copied, so that the rest of the data isn't
+// kept alive along with them.
+func (c *capturer) headersOnly(packet gopacket.Packet) gopacket.Packet {
+	data := packet.Data()
+	length := headerLength(packet)
+	if length >= len(data) {
+		// Nothing to cut, but decode all layers while we own the packet
+		packet.Layers()
+		return packet
+	}
+	md := *packet.Metadata()
+	md.CaptureLength = length
+	md.Truncated = true
+	opts := c.opts.DecodeOptions
+	opts.Lazy = false
+	opts.NoCopy = true
+	headers := gopacket.NewPacket(append([]byte(nil), data[:length]...), firstLayerType(packet), opts)
+	*headers.Metadata() = md
+	return headers
+}
+
+func tcpFlags(tcp *layers.TCP) TCPFlags {
+	var flags TCPFlags
+	for _, f := range []struct {
+		set  bool
+		flag TCPFlags
+	}{
+		{tcp.FIN, TCPFlagFIN},
+		{tcp.SYN, TCPFlagSYN},
+		{tcp.RST, TCPFlagRST},
+		{tcp.PSH, TCPFlagPSH},
+		{tcp.ACK, TCPFlagACK},
+		{tcp.URG, TCPFlagURG},
+		{tcp.ECE, TCPFlagECE},
+		{tcp.CWR, TCPFlagCWR},
+	} {
+		if f.set {
+			flags |= f.flag
+		}
+	}
+	return flags
+}
+
+// appendKey appends the key for ip, whose string form is str, to keys, unless
+// it's already there or ip isn't allowed (see Opts.AllowedIPs).
+func (c *capturer) appendKey(keys []string, ip net.IP, str string) []string {
+	if !c.allowed(ip) {
+		return keys
+	}
+	key := c.keyIP(ip, str)
+	for _, existing := range keys {
+		if existing == key {
+			return keys
+		}
+	}
+	return append(keys, key)
+}
+
+// allowed reports whether packets of ip may be kept (see Opts.AllowedIPs).
+func (c *capturer) allowed(ip net.IP) bool {
+	if len(c.allowedNets) == 0 {
+		return true
+	}
+	for _, network := range c.allowedNets {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// pairKey returns the key for the conversation between a and b with
+// Opts.KeyByPair, which is the same whichever of them sent the packet: their
+// keys (see keyIP), lower IP first, joined by pairSeparator.
+func (c *capturer) pairKey(a net.IP, b net.IP) string {
+	if bytes.Compare(a.To16(), b.To16()) > 0 {
+		a, b = b, a
+	}
+	return c.keyIP(a, a.String()) + pairSeparator + c.keyIP(b, b.String())
+}
+
+// parseNetwork parses s as a network in CIDR notation or a single IP.
+func parseNetwork(s string) (*net.IPNet, error) {
+	if strings.Contains(s, "/") {
+		_, network, err := net.ParseCIDR(s)
+		return network, err
+	}
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, errors.New("not an IP or network")
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+}
+
+// store adds packet to the buffer for key, reporting whether it succeeded.
+func (c *capturer) store(key bufferKey, packet gopacket.Packet) bool {
+	if c.rolling {
+		rf, err := c.getRollingFile(key)
+		if err != nil {
+			reportError(err)
+			return false
+		}
+		if err := rf.write(c.captureData(packet)); err != nil {
+			reportError(err)
+		}
+		return true
+	}
+	buffer := c.getBuffer(key)
+	if buffer.push(packet) && c.opts.OnOverflow != nil {
+		c.reportOverflow(key, buffer)
+	}
+	return true
+}
+
+// reportOverflow calls Opts.OnOverflow for the full buffer for key, unless it
+// did so within Opts.OverflowInterval.
+func (c *capturer) reportOverflow(key bufferKey, buffer *packetRing) {
+	interval := c.opts.OverflowInterval
+	if interval <= 0 {
+		interval = DefaultOverflowInterval
+	}
+	now := c.clock.Now()
+	if now.Sub(buffer.overflowReported) < interval {
+		return
+	}
+	buffer.overflowReported = now
+	c.opts.OnOverflow(key.ip)
+}
+
+// newPcapWriter starts a new pcapng section on w for packets from the named
+// interface. pcapgo always writes little-endian blocks, so the byte order of
+// our files doesn't depend on the host.
+func (c *capturer) newPcapWriter(w io.Writer, interfaceName string, comment string, snapLen uint32) (*pcapgo.NgWriter, error) {
+	intf := pcapgo.NgInterface{
+		Name:                c.interfaceLabel(interfaceName),
+		Description:         c.interfaceDescription(interfaceName),
+		Filter:              c.opts.Filter,
+		OS:                  runtime.GOOS,
+		SnapLength:          snapLen,
+		TimestampResolution: 9,
+	}
+	intf.LinkType = c.linkType
+	ngOpts := pcapgo.NgWriterOptions{
+		SectionInfo: pcapgo.NgSectionInfo{
+			Hardware:    runtime.GOARCH,
+			OS:          runtime.GOOS,
+			Application: c.opts.Application,
+			Comment:     comment,
+		},
+	}
+	return pcapgo.NewNgWriterInterface(w, intf, ngOpts)
+}
@@ -0,0 +1,187 @@
+package pcapper
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+// ipv4Fragments returns the two fragments of a UDP datagram to testDstIPv4,
+// the first with the UDP header and the second with only the rest of the
+// payload.
+func ipv4Fragments(t *testing.T, ts time.Time) []gopacket.Packet {
+	udp := gopacket.Payload{0x27, 0x10, 0x00, 0x35, 0x00, 0x20, 0x00, 0x00, 1, 2, 3, 4, 5, 6, 7, 8}
+	first := &layers.IPv4{Version: 4, TTL: 64, Id: 42, Flags: layers.IPv4MoreFragments, Protocol: layers.IPProtocolUDP,
+		SrcIP: syntheticSrcIPv4, DstIP: testDstIPv4}
+	second := &layers.IPv4{Version: 4, TTL: 64, Id: 42, FragOffset: 2, Protocol: layers.IPProtocolUDP,
+		SrcIP: syntheticSrcIPv4, DstIP: testDstIPv4}
+	return []gopacket.Packet{
+		testFrame(t, ts, layers.EthernetTypeIPv4, first, udp),
+		testFrame(t, ts.Add(time.Microsecond), layers.EthernetTypeIPv4, second, gopacket.Payload{9, 10, 11, 12, 13, 14, 15, 16}),
+	}
+}
+
+// readDump returns the number of packets in each section of the pcapng file at
+// path.
+func readDump(t *testing.T, path string) []int {
+	t.Helper()
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("Unable to open dump: %v", err)
+	}
+	defer file.Close()
+	var sections []int
+	packets := 0
+	r, err := pcapgo.NewNgReader(file, pcapgo.NgReaderOptions{
+		SectionEndCallback: func([]pcapgo.NgInterface, pcapgo.NgSectionInfo) {
+			sections = append(sections, packets)
+			packets = 0
+		},
+	})
+	if err != nil {
+		t.Fatalf("Unable to read dump: %v", err)
+	}
+	for {
+		_, _, err := r.ReadPacketData()
+		if err == io.EOF {
+			return append(sections, packets)
+		}
+		if err != nil {
+			t.Fatalf("Unable to read packet %d of dump: %v", packets, err)
+		}
+		packets++
+	}
+}
+
+func TestIPv4FragmentsBufferedUnderIP(t *testing.T) {
+	opts := &Opts{}
+	startTestCapture(t, opts)
+	Inject(ipv4Fragments(t, time.Now())...)
+
+	buffered := Buffered()
+	if len(buffered) != 1 || len(buffered[testDstIPv4.String()]) != 2 {
+		t.Fatalf("expected both fragments buffered under %v, got %v", testDstIPv4, buffered)
+	}
+	if packet := buffered[testDstIPv4.String()][1]; packet.Layer(gopacket.LayerTypeFragment) == nil {
+		t.Fatalf("expected the second packet to be a fragment without a transport header, got %v", packet)
+	}
+	if _, err := DumpNow(testDstIPv4.String(), "fragments"); err != nil {
+		t.Fatalf("Unable to dump: %v", err)
+	}
+	if sections := readDump(t, filepath.Join(opts.Dir, testDstIPv4.String()+".pcapng")); len(sections) != 1 || sections[0] != 2 {
+		t.Fatalf("expected one section with both fragments, got %v", sections)
+	}
+}
+
+func TestIPv6ExtensionHeadersBufferedUnderIP(t *testing.T) {
+	// Hop-by-hop options with a single PadN option, padding the header to 8
+	// bytes
+	hopByHop := append([]byte{byte(layers.IPProtocolUDP), 0, 1, 4, 0, 0, 0, 0}, testUDP...)
+	// The first fragment, with more to come, carries the UDP header, the
+	// second, at an offset of 16 bytes, only the rest of the payload
+	firstFragment := append([]byte{byte(layers.IPProtocolUDP), 0, 0x00, 0x01, 0, 0, 0, 42}, testUDP...)
+	secondFragment := []byte{byte(layers.IPProtocolUDP), 0, 0x00, 0x10, 0, 0, 0, 42, 5, 6, 7, 8}
+
+	opts := &Opts{}
+	startTestCapture(t, opts)
+	now := time.Now()
+	Inject(
+		testFrame(t, now, layers.EthernetTypeIPv6, rawIPv6(layers.IPProtocolIPv6HopByHop, hopByHop...)),
+		testFrame(t, now.Add(time.Microsecond), layers.EthernetTypeIPv6, rawIPv6(layers.IPProtocolIPv6Fragment, firstFragment...)),
+		testFrame(t, now.Add(2*time.Microsecond), layers.EthernetTypeIPv6, rawIPv6(layers.IPProtocolIPv6Fragment, secondFragment...)),
+	)
+
+	buffered := Buffered()
+	packets := buffered[testDstIPv6.String()]
+	if len(buffered) != 1 || len(packets) != 3 {
+		t.Fatalf("expected all packets buffered under %v, got %v", testDstIPv6, buffered)
+	}
+	for i, layerType := range []gopacket.LayerType{layers.LayerTypeIPv6HopByHop, layers.LayerTypeIPv6Fragment, layers.LayerTypeIPv6Fragment} {
+		if packets[i].Layer(layerType) == nil {
+			t.Fatalf("expected packet %d to have a %v header, got %v", i, layerType, packets[i])
+		}
+	}
+	if _, err := DumpNow(testDstIPv6.String(), "extension headers"); err != nil {
+		t.Fatalf("Unable to dump: %v", err)
+	}
+	if sections := readDump(t, filepath.Join(opts.Dir, testDstIPv6.String()+".pcapng")); len(sections) != 1 || sections[0] != 3 {
+		t.Fatalf("expected one section with all packets, got %v", sections)
+	}
+}
+
+func TestBufferHeadersOnly(t *testing.T) {
+	opts := &Opts{BufferHeadersOnly: true}
+	startTestCapture(t, opts)
+	packet := SyntheticPackets(1, 1)[0]
+	Inject(packet)
+
+	buffered := Buffered()["198.18.0.0"]
+	if len(buffered) != 1 {
+		t.Fatalf("expected 1 packet buffered, got %d", len(buffered))
+	}
+	headers := buffered[0]
+	// Ethernet, IPv4 and UDP headers, without the 64 bytes of payload
+	const headersLen = 14 + 20 + 8
+	if len(headers.Data()) != headersLen {
+		t.Fatalf("expected %d bytes of headers, got %d", headersLen, len(headers.Data()))
+	}
+	md := headers.Metadata()
+	if md.CaptureLength != headersLen || md.Length != packet.Metadata().Length || !md.Truncated {
+		t.Fatalf("expected truncated metadata with the original length %d, got %+v", packet.Metadata().Length, md.CaptureInfo)
+	}
+	if udp, ok := headers.Layer(layers.LayerTypeUDP).(*layers.UDP); !ok || udp.DstPort != 53 {
+		t.Fatalf("expected the UDP header to be decoded, got %v", headers)
+	}
+
+	if _, err := DumpNow("198.18.0.0", "headers"); err != nil {
+		t.Fatalf("Unable to dump: %v", err)
+	}
+	file, err := os.Open(filepath.Join(opts.Dir, "198.18.0.0.pcapng"))
+	if err != nil {
+		t.Fatalf("Unable to open dump: %v", err)
+	}
+	defer file.Close()
+	r, err := pcapgo.NewNgReader(file, pcapgo.NgReaderOptions{})
+	if err != nil {
+		t.Fatalf("Unable to read dump: %v", err)
+	}
+	data, ci, err := r.ReadPacketData()
+	if err != nil {
+		t.Fatalf("Unable to read packet: %v", err)
+	}
+	if len(data) != headersLen || ci.Length != packet.Metadata().Length {
+		t.Fatalf("expected %d bytes of a %d byte packet, got %d of %d", headersLen, packet.Metadata().Length, len(data), ci.Length)
+	}
+}
+
+func TestTCPFlags(t *testing.T) {
+	startTestCapture(t, &Opts{TCPFlags: TCPFlagSYN | TCPFlagFIN})
+	ip := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolTCP, SrcIP: syntheticSrcIPv4, DstIP: testDstIPv4}
+	syn := &layers.TCP{SrcPort: 10000, DstPort: 80, SYN: true}
+	ack := &layers.TCP{SrcPort: 10000, DstPort: 80, ACK: true}
+	fin := &layers.TCP{SrcPort: 10000, DstPort: 80, FIN: true, ACK: true}
+	udp := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolUDP, SrcIP: syntheticSrcIPv4, DstIP: testDstIPv4}
+	now := time.Now()
+	Inject(
+		testFrame(t, now, layers.EthernetTypeIPv4, ip, syn),
+		testFrame(t, now.Add(time.Microsecond), layers.EthernetTypeIPv4, ip, ack),
+		testFrame(t, now.Add(2*time.Microsecond), layers.EthernetTypeIPv4, udp, gopacket.Payload(testUDP)),
+		testFrame(t, now.Add(3*time.Microsecond), layers.EthernetTypeIPv4, ip, fin),
+	)
+	packets := Buffered()[testDstIPv4.String()]
+	if len(packets) != 2 {
+		t.Fatalf("expected only the SYN and FIN packets to be kept, got %d packets", len(packets))
+	}
+	for i, want := range []TCPFlags{TCPFlagSYN, TCPFlagFIN} {
+		tcp, ok := packets[i].Layer(layers.LayerTypeTCP).(*layers.TCP)
+		if !ok || tcpFlags(tcp)&want == 0 {
+			t.Fatalf("expected packet %d to have flag %v, got %v", i, want, packets[i])
+		}
+	}
+}
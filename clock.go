@@ -0,0 +1,26 @@
+package pcapper
+
+import (
+	"time"
+)
+
+// Clock tells the time for the parts of capture that depend on it, so that
+// tests can control it (see Opts.Clock).
+type Clock interface {
+	// Now returns the current time.
+	Now() time.Time
+
+	// After returns a channel on which the time is sent once d has passed.
+	After(d time.Duration) <-chan time.Time
+}
+
+// realClock is the Clock of the time package.
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
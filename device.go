@@ -0,0 +1,19 @@
+package pcapper
+
+import (
+	"net"
+)
+
+// Device describes a network interface that packets can be captured from (see
+// ListInterfaces).
+type Device struct {
+	// Name is what to pass as the interface to capture from.
+	Name string
+
+	// Description is a human readable description of the interface, if one is
+	// available.
+	Description string
+
+	// Addresses are the addresses of the interface.
+	Addresses []*net.IPNet
+}
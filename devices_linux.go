@@ -0,0 +1,60 @@
+package pcapper
+
+import (
+	"net"
+	"strings"
+
+	"github.com/google/gopacket/pcap"
+)
+
+// ValidateInterface checks that the named interface exists and can be
+// captured from, so that a configuration mistake can be reported up front.
+// The error tells apart names that don't exist, listing those that do, from
+// interfaces that can't be opened, for example for lack of permission.
+func ValidateInterface(name string) error {
+	devs, err := pcap.FindAllDevs()
+	if err != nil {
+		return log.Errorf("Unable to list interfaces: %v", err)
+	}
+	names := make([]string, 0, len(devs))
+	for _, dev := range devs {
+		if dev.Name == name {
+			return checkCapturable(name)
+		}
+		names = append(names, dev.Name)
+	}
+	return log.Errorf("No interface named %v, available interfaces are: %v", name, strings.Join(names, ", "))
+}
+
+// ListInterfaces returns the interfaces that packets can be captured from, for
+// example to let users pick one.
+func ListInterfaces() ([]*Device, error) {
+	devs, err := pcap.FindAllDevs()
+	if err != nil {
+		return nil, log.Errorf("Unable to list interfaces: %v", err)
+	}
+	devices := make([]*Device, 0, len(devs))
+	for _, dev := range devs {
+		device := &Device{Name: dev.Name, Description: dev.Description}
+		for _, addr := range dev.Addresses {
+			device.Addresses = append(device.Addresses, &net.IPNet{IP: addr.IP, Mask: addr.Netmask})
+		}
+		devices = append(devices, device)
+	}
+	return devices, nil
+}
+
+// checkCapturable opens the named interface for capture and closes it again.
+func checkCapturable(name string) error {
+	inactive, err := pcap.NewInactiveHandle(name)
+	if err != nil {
+		return log.Errorf("Unable to open %v for packet capture: %v", name, err)
+	}
+	defer inactive.CleanUp()
+	handle, err := inactive.Activate()
+	if err != nil {
+		return log.Errorf("Unable to capture on %v: %v", name, err)
+	}
+	handle.Close()
+	return nil
+}
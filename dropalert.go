@@ -0,0 +1,71 @@
+package pcapper
+
+import (
+	"sync"
+	"time"
+)
+
+// DefaultDropAlertInterval is how often drop alerts are evaluated if
+// Opts.StatsInterval isn't set.
+const DefaultDropAlertInterval = 10 * time.Second
+
+var (
+	dropAlerts   []*dropAlert
+	dropAlertsMx sync.Mutex
+)
+
+type dropAlert struct {
+	threshold float64
+	fn        func(stats *Stats)
+	// received and dropped are pcap's counters when the alert was last
+	// evaluated.
+	received int
+	dropped  int
+}
+
+// RegisterDropAlert registers fn to be called whenever the share of packets
+// that pcap dropped because its buffer was full exceeds threshold, a fraction
+// between 0 and 1, for example to raise an alert or to tighten Opts.Filter. The
+// share is that of the packets received since the alert was last evaluated,
+// which happens every Opts.StatsInterval, or every DefaultDropAlertInterval if
+// that isn't set. fn receives the current stats and, like Opts.OnStats, runs on
+// the capture goroutine.
+//
+// Alerts may be registered before or during capture and stay registered for
+// the life of the process.
+func RegisterDropAlert(threshold float64, fn func(stats *Stats)) {
+	dropAlertsMx.Lock()
+	dropAlerts = append(dropAlerts, &dropAlert{threshold: threshold, fn: fn, received: -1})
+	dropAlertsMx.Unlock()
+}
+
+// hasDropAlerts reports whether any drop alerts are registered.
+func hasDropAlerts() bool {
+	dropAlertsMx.Lock()
+	defer dropAlertsMx.Unlock()
+	return len(dropAlerts) > 0
+}
+
+// checkDropAlerts evaluates all registered drop alerts against stats.
+func checkDropAlerts(stats *Stats) {
+	dropAlertsMx.Lock()
+	var fire []*dropAlert
+	for _, a := range dropAlerts {
+		received, dropped := stats.PacketsReceived-a.received, stats.PacketsDropped-a.dropped
+		first := a.received < 0
+		a.received, a.dropped = stats.PacketsReceived, stats.PacketsDropped
+		if first || received < 0 || dropped < 0 {
+			// Nothing to compare with, or the counters were reset by reopening
+			// the interface
+			continue
+		}
+		if received > 0 && float64(dropped)/float64(received) > a.threshold {
+			fire = append(fire, a)
+		}
+	}
+	dropAlertsMx.Unlock()
+	// Called without holding the lock, so that fn may register alerts
+	for _, a := range fire {
+		a.fn(stats)
+	}
+}
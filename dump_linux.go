@@ -0,0 +1,877 @@
+package pcapper
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"math"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+// dumpJob is a snapshot of a buffer that is handed to a dump worker.
+type dumpJob struct {
+	key     bufferKey
+	comment string
+	packets []gopacket.Packet
+	result  chan *dumpResult
+}
+
+// dumpResult is the outcome of a dumpJob.
+type dumpResult struct {
+	key     bufferKey
+	files   []string
+	packets int
+	err     error
+}
+
+// add adds the outcome of a dump job to dr, whose files are under baseDir (see
+// baseDirFor).
+func (dr *DumpResult) add(result *dumpResult, baseDir string) {
+	dr.Files = append(dr.Files, result.files...)
+	for _, file := range result.files {
+		rel, err := filepath.Rel(baseDir, file)
+		if err != nil {
+			// Only if one of them is absolute and the other isn't, which
+			// Rule.Dir and Opts.Dir may be
+			rel = file
+		}
+		dr.RelativeFiles = append(dr.RelativeFiles, filepath.ToSlash(rel))
+	}
+	dr.Packets += result.packets
+	if result.err != nil && dr.Err == nil {
+		dr.Err = result.err
+	}
+}
+
+// dumpIP dumps the buffers for ip. If keep is true, the buffers are left in
+// place rather than cleared.
+func (c *capturer) dumpIP(ip string, comment string, keep bool) {
+	keys := c.keysFor(ip)
+	// Dumps are recorded by the IP of the key (see snapshot), which is a pair
+	// with KeyByPair, so that's what is checked, once for all of its buffers
+	skip := make(map[string]bool, 1)
+	for _, key := range keys {
+		if _, checked := skip[key.ip]; !checked {
+			skip[key.ip] = c.tooSoon(key.ip)
+		}
+	}
+	var jobs []*dumpJob
+	for _, key := range keys {
+		if !skip[key.ip] {
+			jobs = c.snapshot(jobs, key, comment, keep)
+		}
+	}
+	c.dispatch(jobs, false)
+}
+
+// tooSoon reports whether ip was dumped less than Opts.MinDumpInterval ago, so
+// that dumping it again should be skipped.
+func (c *capturer) tooSoon(ip string) bool {
+	if c.opts.MinDumpInterval <= 0 {
+		return false
+	}
+	last, found := c.lastDumpedAt(ip)
+	if !found {
+		return false
+	}
+	since := c.clock.Now().Sub(last)
+	if since >= c.opts.MinDumpInterval {
+		return false
+	}
+	c.dumpsSkipped++
+	log.Debugf("Skipping dump of %v, it was dumped %v ago", ip, since)
+	return true
+}
+
+// lastDumpedAt returns when ip was last dumped, if it's remembered. With
+// KeyByPair, that's the latest dump of any of the pairs of ip.
+func (c *capturer) lastDumpedAt(ip string) (time.Time, bool) {
+	ip = c.keyString(ip)
+	if last, found := c.lastDumped.Peek(ip); found {
+		return last.(time.Time), true
+	}
+	if !c.opts.KeyByPair {
+		return time.Time{}, false
+	}
+	var latest time.Time
+	found := false
+	for _, _key := range c.lastDumped.Keys() {
+		if !c.keyMatches(_key.(string), ip) {
+			continue
+		}
+		if _last, ok := c.lastDumped.Peek(_key); ok {
+			if last := _last.(time.Time); !found || last.After(latest) {
+				latest, found = last, true
+			}
+		}
+	}
+	return latest, found
+}
+
+// dumpMatching dumps the buffers of all IPs that match pattern (see
+// DumpMatching).
+func (c *capturer) dumpMatching(pattern string, comment string) {
+	var jobs []*dumpJob
+	matches := 0
+	for _, _key := range c.buffersByIP.Keys() {
+		key := _key.(bufferKey)
+		if matched, _ := path.Match(pattern, key.ip); matched {
+			matches++
+			jobs = c.snapshot(jobs, key, comment, false)
+		}
+	}
+	log.Debugf("Dumping %d buffers matching %v", matches, pattern)
+	c.dispatch(jobs, true)
+}
+
+// dumpAll dumps all buffers. If wait is true, it waits for the dumps to finish
+// and returns the first error encountered.
+func (c *capturer) dumpAll(comment string, wait bool) error {
+	log.Debug("Dumping packets for all IP addresses")
+	var jobs []*dumpJob
+	for _, key := range c.buffersByIP.Keys() {
+		jobs = c.snapshot(jobs, key.(bufferKey), comment, false)
+	}
+	if !wait {
+		c.dispatch(jobs, true)
+		return nil
+	}
+
+	var firstErr error
+	for _, result := range c.runJobs(jobs) {
+		if result.err != nil && firstErr == nil {
+			firstErr = result.err
+		}
+	}
+	return firstErr
+}
+
+// snapshot takes the buffer for key out of the cache, or just copies it if keep
+// is true, and appends a job for dumping it to jobs. It must be called on the
+// capture goroutine.
+func (c *capturer) snapshot(jobs []*dumpJob, key bufferKey, comment string, keep bool) []*dumpJob {
+	log.Debugf("Attempting to dump pcaps for %v with comment %v", key.ip, comment)
+	if c.opts.InMemory {
+		log.Debugf("Not dumping pcaps for %v to disk in memory-only mode", key.ip)
+		return jobs
+	}
+	_buffer, found := c.buffersByIP.Peek(key)
+	if !found {
+		log.Debugf("No pcaps to dump for %v", key.ip)
+		return jobs
+	}
+
+	if c.rolling {
+		// Packets are already on disk, just make sure they're flushed
+		if err := c.flushRollingFile(key, _buffer.(*rollingFile)); err != nil {
+			reportError(err)
+		}
+		return jobs
+	}
+
+	c.lastDumped.Add(key.ip, c.clock.Now())
+	if !keep {
+		c.buffersByIP.Remove(key)
+	}
+	buffer := _buffer.(*packetRing)
+	var packets []gopacket.Packet
+	if keep {
+		packets = c.copyBuffer(nil, buffer, true)
+	} else {
+		// The buffer is out of the cache, so the dump can have its storage
+		// rather than a copy, which matters with a large PacketsPerIP
+		buffer.expire(c.clock.Now())
+		packets = buffer.take()
+	}
+	if len(packets) == 0 {
+		log.Debugf("No pcaps to dump for %v", key.ip)
+		return jobs
+	}
+	return append(jobs, &dumpJob{key: key, comment: comment, packets: packets})
+}
+
+// copyBuffer appends the packets in buffer to packets. keep says whether they
+// stay in the buffer while another goroutine reads them.
+func (c *capturer) copyBuffer(packets []gopacket.Packet, buffer *packetRing, keep bool) []gopacket.Packet {
+	// Packets only expire as new ones arrive, so those of a quiet IP may have
+	// outlived Opts.BufferDuration
+	buffer.expire(c.clock.Now())
+	buffer.forEach(func(packet gopacket.Packet) bool {
+		if keep && c.opts.DecodeOptions.Lazy {
+			// Decoding the packet completely now means that neither goroutine
+			// modifies it from then on.
+			packet.Layers()
+		}
+		packets = append(packets, packet)
+		return true
+	})
+	return packets
+}
+
+// writeTo writes packets to w as a pcapng section like that of a dump of key,
+// but without filtering or splitting them.
+func (c *capturer) writeTo(w io.Writer, key bufferKey, comment string, packets []gopacket.Packet) error {
+	sortByTimestamp(packets)
+	pcaps, err := c.newPcapWriter(w, c.interfaceFor(key), comment, uint32(c.snapLen))
+	if err != nil {
+		return err
+	}
+	for _, packet := range packets {
+		if err := pcaps.WritePacket(c.captureData(packet)); err != nil {
+			return err
+		}
+	}
+	return pcaps.Flush()
+}
+
+// dispatch hands jobs to the dump workers from a separate goroutine, so that
+// the capture goroutine never waits on them. If report is true, the totals are
+// logged once all jobs are done.
+func (c *capturer) dispatch(jobs []*dumpJob, report bool) {
+	if len(jobs) == 0 {
+		return
+	}
+	c.dispatchers.Add(1)
+	go func() {
+		defer c.dispatchers.Done()
+		results := c.runJobs(jobs)
+		files, packets, failed := 0, 0, 0
+		for _, result := range results {
+			if result.err != nil {
+				reportError(result.err)
+				failed++
+				continue
+			}
+			files += len(result.files)
+			packets += result.packets
+		}
+		if !report {
+			return
+		}
+		log.Debugf("Dumped %d packets to %d files, %d dumps failed", packets, files, failed)
+	}()
+}
+
+// runJobs runs jobs on the dump workers and waits for their results.
+func (c *capturer) runJobs(jobs []*dumpJob) []*dumpResult {
+	resultsCh := make(chan *dumpResult, len(jobs))
+	for _, job := range jobs {
+		job.result = resultsCh
+		c.dumpJobs <- job
+	}
+	results := make([]*dumpResult, 0, len(jobs))
+	for range jobs {
+		results = append(results, <-resultsCh)
+	}
+	return results
+}
+
+// addRecentDump records the result of a dump job that wrote anything or failed
+// for RecentDumps, forgetting the oldest once Opts.RecentDumps are recorded.
+func (c *capturer) addRecentDump(result *dumpResult) {
+	if len(result.files) == 0 && result.err == nil {
+		return
+	}
+	dr := &DumpResult{IP: result.key.ip, Time: c.clock.Now()}
+	dr.add(result, c.baseDirFor(result.key))
+	max := c.opts.RecentDumps
+	if max <= 0 {
+		max = DefaultRecentDumps
+	}
+	c.recentDumpsMx.Lock()
+	defer c.recentDumpsMx.Unlock()
+	if len(c.recentDumps) >= max {
+		n := copy(c.recentDumps, c.recentDumps[len(c.recentDumps)-max+1:])
+		c.recentDumps = c.recentDumps[:n]
+	}
+	c.recentDumps = append(c.recentDumps, dr)
+}
+
+func (c *capturer) flushRollingFile(key bufferKey, rf *rollingFile) error {
+	if rf.file == nil {
+		return nil
+	}
+	if err := rf.pcaps.Flush(); err != nil {
+		return log.Errorf("Error flushing pcaps to %v: %v", rf.name, err)
+	}
+	log.Debugf("Pcaps for %v are in %v", key.ip, rf.name)
+	return nil
+}
+
+func (c *capturer) dumpWorker() {
+	defer c.workers.Done()
+	for job := range c.dumpJobs {
+		start := time.Now()
+		result := c.writeDump(job)
+		c.dumpWriteMx.Lock()
+		c.dumpWrite.observe(time.Since(start))
+		c.dumpWriteMx.Unlock()
+		c.addRecentDump(result)
+		job.result <- result
+	}
+}
+
+// writeDump writes the packets of a dump job to disk.
+func (c *capturer) writeDump(job *dumpJob) *dumpResult {
+	ip := job.key.ip
+	sortByTimestamp(job.packets)
+
+	// Reserve all the files this dump may open up front, so that dumps can't
+	// deadlock waiting on each other for their second file
+	numFiles := 1
+	if c.opts.SplitByDirection {
+		numFiles = 2
+	}
+	c.fileSlots.acquire(numFiles)
+	defer c.fileSlots.release(numFiles)
+
+	now := c.clock.Now()
+	var stamp string
+	if c.opts.DumpTimestampFormat != "" {
+		stamp = now.Format(c.opts.DumpTimestampFormat)
+	}
+	dir := c.dirFor(job.key)
+	if c.opts.DirPerDay {
+		dir = filepath.Join(dir, now.Format("2006-01-02"))
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return &dumpResult{key: job.key, err: log.Errorf("Unable to create directory %v: %v", dir, err)}
+		}
+	}
+	var host string
+	if c.opts.HostnamesInFileNames {
+		host = c.fileNameHost(ip)
+	}
+	if c.opts.DumpFormat == DumpFormatFlows {
+		return c.writeFlowDump(job, dir, host, stamp)
+	}
+	result := &dumpResult{key: job.key}
+	outs := make(map[string]*dumpFile, 2)
+	// Files are opened lazily, as split dumps may have nothing to write in one
+	// of the directions
+	outFor := func(fileName string) (*dumpFile, error) {
+		out := outs[fileName]
+		if out == nil {
+			var err error
+			out, err = c.openDumpFile(filepath.Join(dir, fileName), c.interfaceFor(job.key), job.comment)
+			if err != nil {
+				return nil, err
+			}
+			outs[fileName] = out
+			result.files = append(result.files, out.name)
+		}
+		return out, nil
+	}
+	defer func() {
+		for _, out := range outs {
+			out.close()
+		}
+	}()
+
+	var writePacket func(direction string, packet gopacket.Packet) (*dumpFile, error)
+	dumpPacket := func(dst net.IP, src net.IP, packet gopacket.Packet) error {
+		var inbound bool
+		if c.opts.KeyFunc != nil {
+			// Keys needn't be addresses of the packet, so all packets in the
+			// buffer belong to it
+			inbound = src.String() == ip
+		} else if c.opts.KeyByPair {
+			if c.pairKey(dst, src) != ip {
+				return nil
+			}
+			// Packets from the second IP of the pair are inbound
+			inbound = bytes.Compare(src.To16(), dst.To16()) > 0
+		} else {
+			dstIP, srcIP := c.keyIP(dst, dst.String()), c.keyIP(src, src.String())
+			if dstIP != ip && srcIP != ip {
+				return nil
+			}
+			// ip is the remote side, so packets from it are inbound. This
+			// matches how capturePacket decides which side to key on.
+			inbound = srcIP == ip
+		}
+		direction := ""
+		if c.opts.SplitByDirection {
+			if inbound {
+				direction = "in"
+			} else {
+				direction = "out"
+			}
+		}
+		out, err := writePacket(direction, packet)
+		if out != nil {
+			out.addIPs(dst, src)
+		}
+		return err
+	}
+
+	writePacket = func(direction string, packet gopacket.Packet) (*dumpFile, error) {
+		fileName := job.key.dumpFileName(host, stamp, direction)
+		if c.aead != nil {
+			fileName += ".enc"
+		}
+		out, err := outFor(fileName)
+		if err != nil {
+			return nil, err
+		}
+		ci, data := c.captureData(packet)
+		if err := out.pcaps.WritePacket(ci, data); err != nil {
+			// The rest of the section would be garbled, so give up on it
+			return nil, log.Errorf("Error writing packet to %v: %v", out.name, describeWriteError(out.name, err))
+		}
+		result.packets++
+		return out, nil
+	}
+
+	catchAll := c.catchAllKey != "" && ip == c.catchAllKey
+	for _, packet := range job.packets {
+		var err error
+		nl := c.networkLayer(packet)
+		switch t := nl.(type) {
+		case *layers.IPv4:
+			err = dumpPacket(t.DstIP, t.SrcIP, packet)
+		case *layers.IPv6:
+			err = dumpPacket(t.DstIP, t.SrcIP, packet)
+		default:
+			if catchAll {
+				_, err = writePacket("", packet)
+			}
+		}
+		if err != nil {
+			result.err = err
+			return result
+		}
+	}
+
+	if c.opts.ResolveNames {
+		timeout := c.opts.ResolveTimeout
+		if timeout <= 0 {
+			timeout = DefaultResolveTimeout
+		}
+		for _, out := range outs {
+			if err := out.writeNames(timeout); err != nil && result.err == nil {
+				result.err = err
+			}
+		}
+	}
+	for _, out := range outs {
+		if err := out.close(); err != nil && result.err == nil {
+			result.err = err
+		}
+	}
+	if result.err == nil {
+		log.Debugf("Logged pcaps for %v to %v", ip, strings.Join(result.files, ", "))
+	}
+	return result
+}
+
+// writeFlowDump writes the packets of a dump job as a flow log to dir.
+func (c *capturer) writeFlowDump(job *dumpJob, dir string, host string, stamp string) *dumpResult {
+	result := &dumpResult{key: job.key}
+	fileName := filepath.Join(dir, strings.TrimSuffix(job.key.dumpFileName(host, stamp, ""), ".pcapng")+".flows")
+	unlock := lockFile(fileName)
+	defer unlock()
+
+	// Readable too, to check the header of an existing log
+	flags := os.O_RDWR | os.O_APPEND | os.O_CREATE
+	if c.opts.RefuseExistingFiles {
+		flags |= os.O_EXCL
+	}
+	file, err := os.OpenFile(fileName, flags, 0644)
+	if err != nil {
+		result.err = log.Errorf("Unable to open flow log %v: %v", fileName, err)
+		return result
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		result.err = log.Errorf("Unable to stat flow log %v: %v", fileName, err)
+		return result
+	}
+	if info.Size() == 0 {
+		err = writeFlowLogHeader(file)
+	} else {
+		err = checkFlowLog(io.NewSectionReader(file, 0, info.Size()))
+	}
+	if err != nil {
+		result.err = log.Errorf("Unable to append to flow log %v: %v", fileName, err)
+		return result
+	}
+	flows := buildFlows(job.packets)
+	if err := writeFlowRecords(file, flows); err != nil {
+		result.err = log.Errorf("Error writing flow log %v: %v", fileName, describeWriteError(fileName, err))
+		return result
+	}
+	if err := file.Close(); err != nil {
+		result.err = log.Errorf("Unable to close flow log %v: %v", fileName, err)
+		return result
+	}
+	result.files = append(result.files, fileName)
+	for _, flow := range flows {
+		result.packets += flow.Packets
+	}
+	log.Debugf("Logged %d flows for %v to %v", len(flows), job.key.ip, fileName)
+	return result
+}
+
+// fileNameHost returns the name of ip for use in file names, or "" if ip isn't
+// a single IP or has no name that resolves in time.
+func (c *capturer) fileNameHost(ip string) string {
+	if net.ParseIP(ip) == nil {
+		return ""
+	}
+	timeout := c.opts.ResolveTimeout
+	if timeout <= 0 {
+		timeout = DefaultResolveTimeout
+	}
+	return sanitizeHostname(resolveNames([]string{ip}, timeout)[ip])
+}
+
+// captureData returns packet as it is written to disk, truncated according to
+// Opts.PayloadSnapLen and shifted by Opts.TimestampOffset. The packet itself is
+// left alone.
+func (c *capturer) captureData(packet gopacket.Packet) (gopacket.CaptureInfo, []byte) {
+	ci := packet.Metadata().CaptureInfo
+	// All packets are written for the file's single interface
+	ci.InterfaceIndex = 0
+	ci.Timestamp = ci.Timestamp.Add(c.opts.TimestampOffset)
+	data := packet.Data()
+	if c.opts.PayloadSnapLen > 0 {
+		if keep := headerLength(packet) + c.opts.PayloadSnapLen; keep < len(data) {
+			data = data[:keep]
+			ci.CaptureLength = keep
+		}
+	}
+	return ci, data
+}
+
+// firstLayerType returns the type of the outermost layer of packet, its link
+// layer, or its network layer for raw IP captures.
+func firstLayerType(packet gopacket.Packet) gopacket.LayerType {
+	if ll := packet.LinkLayer(); ll != nil {
+		return ll.LayerType()
+	}
+	if nl := packet.NetworkLayer(); nl != nil {
+		return nl.LayerType()
+	}
+	return gopacket.LayerTypePayload
+}
+
+// headerLength returns the length of the headers of packet up to and including
+// its transport layer, or its network layer if it has no transport layer. If
+// it has neither, the whole packet counts as headers.
+func headerLength(packet gopacket.Packet) int {
+	var last gopacket.Layer
+	if tl := packet.TransportLayer(); tl != nil {
+		last = tl
+	} else if nl := packet.NetworkLayer(); nl != nil {
+		last = nl
+	} else {
+		return len(packet.Data())
+	}
+	// Sum up the layers rather than subtracting the payload from the end, as
+	// frames may be padded after the payload
+	length := 0
+	for _, layer := range packet.Layers() {
+		length += len(layer.LayerContents())
+		if layer == last {
+			return length
+		}
+	}
+	return len(packet.Data())
+}
+
+// dumpFile is a pcap file that a dump is being written to.
+type dumpFile struct {
+	name   string
+	file   *os.File
+	w      io.Writer // what pcaps writes to
+	pcaps  *pcapgo.NgWriter
+	enc    *encryptingWriter // nil unless encrypting
+	hash   hash.Hash         // nil unless checksumming
+	ips    map[string]bool   // nil unless resolving names
+	unlock func()
+}
+
+// addIPs records the IPs of a packet written to the file, for resolving their
+// names.
+func (out *dumpFile) addIPs(ips ...net.IP) {
+	if out.ips == nil {
+		return
+	}
+	for _, ip := range ips {
+		out.ips[ip.String()] = true
+	}
+}
+
+// writeNames resolves the names of the IPs recorded by addIPs and writes them
+// to the file in a name resolution block.
+func (out *dumpFile) writeNames(timeout time.Duration) error {
+	if len(out.ips) == 0 {
+		return nil
+	}
+	ips := make([]string, 0, len(out.ips))
+	for ip := range out.ips {
+		ips = append(ips, ip)
+	}
+	names := resolveNames(ips, timeout)
+	// The block goes after the packets that pcaps has buffered
+	if err := out.pcaps.Flush(); err != nil {
+		return log.Errorf("Error flushing pcaps to %v: %v", out.name, describeWriteError(out.name, err))
+	}
+	if err := writeNameResolutionBlock(out.w, names); err != nil {
+		return log.Errorf("Error writing names to %v: %v", out.name, describeWriteError(out.name, err))
+	}
+	return nil
+}
+
+// openDumpFile opens the named file for appending a new pcapng section, creating
+// it if necessary. It holds the file's lock until the dumpFile is closed.
+func (c *capturer) openDumpFile(pcapsFileName string, interfaceName string, comment string) (*dumpFile, error) {
+	unlock := lockFile(pcapsFileName)
+	snapLen := uint32(c.snapLen)
+	if isFIFO(pcapsFileName) {
+		// Pipes can't be checked or appended to, each dump just streams a new
+		// section to the reader
+		pcapsFile, err := openFIFO(pcapsFileName)
+		if err != nil {
+			unlock()
+			return nil, err
+		}
+		return c.startDumpFile(pcapsFileName, pcapsFile, interfaceName, comment, snapLen, unlock)
+	}
+	if c.opts.RefuseExistingFiles {
+		pcapsFile, err := os.OpenFile(pcapsFileName, os.O_CREATE|os.O_EXCL|os.O_RDWR, 0644)
+		if err != nil {
+			unlock()
+			if os.IsExist(err) {
+				return nil, log.Errorf("Refusing to write to existing pcap file %v", pcapsFileName)
+			}
+			return nil, log.Errorf("Unable to create pcap file %v: %v", pcapsFileName, err)
+		}
+		return c.startDumpFile(pcapsFileName, pcapsFile, interfaceName, comment, snapLen, unlock)
+	}
+	pcapsFile, err := os.OpenFile(pcapsFileName, os.O_APPEND|os.O_RDWR, 0644)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			unlock()
+			return nil, log.Errorf("Unable to open pcap file %v: %v", pcapsFileName, err)
+		}
+		pcapsFile, err = os.Create(pcapsFileName)
+		if err != nil {
+			unlock()
+			return nil, log.Errorf("Unable to create pcap file %v: %v", pcapsFileName, err)
+		}
+	} else {
+		snapLen, err = c.checkExisting(pcapsFile)
+		if err != nil {
+			pcapsFile.Close()
+			unlock()
+			return nil, log.Errorf("Refusing to append to pcap file %v: %v", pcapsFileName, err)
+		}
+	}
+	return c.startDumpFile(pcapsFileName, pcapsFile, interfaceName, comment, snapLen, unlock)
+}
+
+// startDumpFile starts a new pcapng section on an opened dump file.
+func (c *capturer) startDumpFile(pcapsFileName string, pcapsFile *os.File, interfaceName string, comment string, snapLen uint32, unlock func()) (*dumpFile, error) {
+	var w io.Writer = pcapsFile
+	var sum hash.Hash
+	if c.opts.ChecksumFiles && !isFIFO(pcapsFileName) {
+		sum = sha256.New()
+		// Hash what's already in the file, then the rest as it's written
+		if _, err := io.Copy(sum, io.NewSectionReader(pcapsFile, 0, math.MaxInt64)); err != nil {
+			pcapsFile.Close()
+			unlock()
+			return nil, log.Errorf("Unable to checksum pcap file %v: %v", pcapsFileName, err)
+		}
+		w = io.MultiWriter(pcapsFile, sum)
+	}
+	var enc *encryptingWriter
+	if c.aead != nil {
+		enc = newEncryptingWriter(w, c.aead)
+		w = enc
+	}
+	pcaps, err := c.newPcapWriter(w, interfaceName, comment, snapLen)
+	if err != nil {
+		pcapsFile.Close()
+		unlock()
+		return nil, log.Errorf("Error opening file %v for writing pcaps: %v", pcapsFileName, err)
+	}
+	out := &dumpFile{
+		name:   pcapsFileName,
+		file:   pcapsFile,
+		w:      w,
+		pcaps:  pcaps,
+		enc:    enc,
+		hash:   sum,
+		unlock: unlock,
+	}
+	if c.opts.ResolveNames {
+		out.ips = make(map[string]bool)
+	}
+	return out, nil
+}
+
+// writeChecksum writes the checksum of the named file to its sidecar file,
+// replacing the sidecar atomically so that it never holds a partial checksum.
+func writeChecksum(name string, sum hash.Hash) error {
+	sidecar := name + ".sha256"
+	tmp := sidecar + ".tmp"
+	line := fmt.Sprintf("%x  %v\n", sum.Sum(nil), filepath.Base(name))
+	if err := ioutil.WriteFile(tmp, []byte(line), 0644); err != nil {
+		return log.Errorf("Unable to write checksum file %v: %v", tmp, err)
+	}
+	if err := os.Rename(tmp, sidecar); err != nil {
+		return log.Errorf("Unable to write checksum file %v: %v", sidecar, err)
+	}
+	return nil
+}
+
+// checkExisting checks that a new section can safely be appended to file and
+// returns the snap length to record for it.
+func (c *capturer) checkExisting(file *os.File) (uint32, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return 0, err
+	}
+	if c.aead != nil {
+		// The pcapng headers are in the first record
+		first, err := checkEncryptedAppendable(file, info.Size(), c.aead)
+		if err != nil {
+			return 0, err
+		}
+		existing, err := readFirstInterface(bytes.NewReader(first), int64(len(first)))
+		if err != nil {
+			return 0, err
+		}
+		return c.appendSnapLen(existing)
+	}
+	if err := checkAppendable(file, info.Size()); err != nil {
+		return 0, err
+	}
+	existing, err := readFirstInterface(file, info.Size())
+	if err != nil {
+		return 0, err
+	}
+	return c.appendSnapLen(existing)
+}
+
+// appendSnapLen returns the snap length for a section appended to a file whose
+// first interface is existing, so that all of the file's sections agree.
+// Sections for a different link type can't be read as one capture, and neither
+// can packets longer than the file's snap length, so those are errors. If the
+// file has a longer snap length than ours, we adopt it, which is harmless since
+// our packets fit.
+func (c *capturer) appendSnapLen(existing *ngInterface) (uint32, error) {
+	snapLen := uint32(c.snapLen)
+	if existing == nil {
+		return snapLen, nil
+	}
+	if existing.linkType != c.linkType {
+		return 0, fmt.Errorf("file has link type %v, not %v", existing.linkType, c.linkType)
+	}
+	// A snap length of 0 means unlimited
+	if existing.snapLen != 0 && (snapLen == 0 || existing.snapLen < snapLen) {
+		return 0, fmt.Errorf("file has snap length %d, shorter than %d", existing.snapLen, snapLen)
+	}
+	return existing.snapLen, nil
+}
+
+// close flushes and closes the file and releases its lock. It is safe to call
+// more than once.
+func (out *dumpFile) close() error {
+	if out.file == nil {
+		return nil
+	}
+	flushErr := out.pcaps.Flush()
+	if flushErr == nil && out.enc != nil {
+		flushErr = out.enc.Close()
+	}
+	out.file.Close()
+	out.file = nil
+	defer out.unlock()
+	if flushErr != nil {
+		return log.Errorf("Error flushing pcaps to %v: %v", out.name, describeWriteError(out.name, flushErr))
+	}
+	if out.hash != nil {
+		// Still holding the file's lock, so the checksum matches the file
+		return writeChecksum(out.name, out.hash)
+	}
+	return nil
+}
+
+// sortByTimestamp puts packets into chronological order. The ring yields
+// packets oldest to newest, so this is normally just a cheap check, but it
+// guarantees that a dump never jumps backwards in time.
+func sortByTimestamp(packets []gopacket.Packet) {
+	timestamp := func(i int) time.Time {
+		return packets[i].Metadata().Timestamp
+	}
+	for i := 1; i < len(packets); i++ {
+		if timestamp(i).Before(timestamp(i - 1)) {
+			sort.SliceStable(packets, func(i, j int) bool {
+				return timestamp(i).Before(timestamp(j))
+			})
+			return
+		}
+	}
+}
+
+// semaphore bounds the number of some resource in use. A nil semaphore is
+// unbounded.
+type semaphore struct {
+	max   int
+	inUse int
+	cond  *sync.Cond
+}
+
+func newSemaphore(max int) *semaphore {
+	if max <= 0 {
+		return nil
+	}
+	return &semaphore{max: max, cond: sync.NewCond(&sync.Mutex{})}
+}
+
+// acquire blocks until n units are available and takes them. Requests for more
+// than the maximum take the maximum.
+func (s *semaphore) acquire(n int) {
+	if s == nil {
+		return
+	}
+	if n > s.max {
+		n = s.max
+	}
+	s.cond.L.Lock()
+	for s.inUse+n > s.max {
+		s.cond.Wait()
+	}
+	s.inUse += n
+	s.cond.L.Unlock()
+}
+
+func (s *semaphore) release(n int) {
+	if s == nil {
+		return
+	}
+	if n > s.max {
+		n = s.max
+	}
+	s.cond.L.Lock()
+	s.inUse -= n
+	s.cond.L.Unlock()
+	s.cond.Broadcast()
+}
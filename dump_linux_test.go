@@ -0,0 +1,137 @@
+package pcapper
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+func TestDumpAppendsSections(t *testing.T) {
+	opts := &Opts{}
+	startTestCapture(t, opts)
+	for i, n := range []int{3, 5} {
+		Inject(SyntheticPackets(n, 1)...)
+		dr, err := DumpNow("198.18.0.0", "dump")
+		if err != nil {
+			t.Fatalf("Unable to dump %d: %v", i, err)
+		}
+		if dr.Packets != n {
+			t.Fatalf("expected dump %d to write %d packets, got %d", i, n, dr.Packets)
+		}
+	}
+	sections := readDump(t, filepath.Join(opts.Dir, "198.18.0.0.pcapng"))
+	if len(sections) != 2 || sections[0] != 3 || sections[1] != 5 {
+		t.Fatalf("expected sections of 3 and 5 packets, got %v", sections)
+	}
+}
+
+func TestDumpRefusesOtherLinkType(t *testing.T) {
+	opts := &Opts{}
+	startTestCapture(t, opts)
+	path := filepath.Join(opts.Dir, "198.18.0.0.pcapng")
+	var existing bytes.Buffer
+	w, err := pcapgo.NewNgWriterInterface(&existing, pcapgo.NgInterface{LinkType: layers.LinkTypeRaw, SnapLength: 65535}, pcapgo.DefaultNgWriterOptions)
+	if err != nil {
+		t.Fatalf("Unable to write existing file: %v", err)
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatalf("Unable to write existing file: %v", err)
+	}
+	if err := ioutil.WriteFile(path, existing.Bytes(), 0644); err != nil {
+		t.Fatalf("Unable to write existing file: %v", err)
+	}
+
+	Inject(SyntheticPackets(3, 1)...)
+	if _, err := DumpNow("198.18.0.0", "dump"); err == nil {
+		t.Fatal("expected dumping Ethernet packets to a raw IP file to fail")
+	}
+	after, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Unable to read existing file: %v", err)
+	}
+	if !bytes.Equal(after, existing.Bytes()) {
+		t.Fatalf("expected the existing file to be left alone, it grew from %d to %d bytes", existing.Len(), len(after))
+	}
+}
+
+func TestDumpResultRelativeToRuleDir(t *testing.T) {
+	dir, ruleDir := t.TempDir(), t.TempDir()
+	c := &capturer{opts: &Opts{Dir: dir, Rules: []*Rule{{Name: "named"}, {Name: "own", Dir: ruleDir}}}}
+	tests := []struct {
+		key  bufferKey
+		file string
+		want string
+	}{
+		{bufferKey{ip: "198.18.0.0"}, filepath.Join(dir, "198.18.0.0.pcapng"), "198.18.0.0.pcapng"},
+		{bufferKey{ip: "198.18.0.0", rule: 1}, filepath.Join(dir, "named", "198.18.0.0.pcapng"), "named/198.18.0.0.pcapng"},
+		{bufferKey{ip: "198.18.0.0", rule: 2}, filepath.Join(ruleDir, "198.18.0.0.pcapng"), "198.18.0.0.pcapng"},
+	}
+	for _, test := range tests {
+		if file := filepath.Join(c.dirFor(test.key), "198.18.0.0.pcapng"); file != test.file {
+			t.Fatalf("expected rule %d to dump to %v, got %v", test.key.rule, test.file, file)
+		}
+		dr := &DumpResult{}
+		dr.add(&dumpResult{key: test.key, files: []string{test.file}}, c.baseDirFor(test.key))
+		if len(dr.RelativeFiles) != 1 || dr.RelativeFiles[0] != test.want {
+			t.Fatalf("expected %v relative to the directory of rule %d to be %v, got %v", test.file, test.key.rule, test.want, dr.RelativeFiles)
+		}
+	}
+}
+
+func TestDumpStopsOnWriteError(t *testing.T) {
+	if _, err := os.Stat("/dev/full"); err != nil {
+		t.Skip("no /dev/full to fail writes")
+	}
+	opts := &Opts{}
+	startTestCapture(t, opts)
+	if err := os.Symlink("/dev/full", filepath.Join(opts.Dir, "198.18.0.0.pcapng")); err != nil {
+		t.Fatalf("Unable to link dump file to /dev/full: %v", err)
+	}
+	// More than fits into the writer's buffer, so writing some of them fails
+	Inject(SyntheticPackets(100, 1)...)
+	dr, err := DumpNow("198.18.0.0", "full")
+	// Rather than only when flushing what's left at the end
+	if err == nil || dr.Err == nil || !strings.Contains(err.Error(), "Error writing packet") {
+		t.Fatalf("expected writing a packet to a full device to fail, got %v", err)
+	}
+	if dr.Packets >= 100 {
+		t.Fatalf("expected writing to stop at the first error, but %d packets were written", dr.Packets)
+	}
+}
+
+func TestMinDumpIntervalKeyByPair(t *testing.T) {
+	startTestCapture(t, &Opts{KeyByPair: true, MinDumpInterval: time.Hour})
+	ip := "198.18.0.0"
+	Inject(SyntheticPackets(3, 1)...)
+	Dump(ip, "first")
+	waitFor(t, "the first dump", func() bool {
+		_, found := LastDumped(ip)
+		return found
+	})
+
+	Inject(SyntheticPackets(3, 1)...)
+	Dump(ip, "second")
+	waitFor(t, "the second dump to be skipped", func() bool {
+		return GetStats().DumpsSkipped == 1
+	})
+	if recent := RecentDumps(); len(recent) != 1 {
+		t.Fatalf("expected only the first dump, got %d", len(recent))
+	}
+}
+
+// waitFor waits for up to 5 seconds for cond to hold.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); !cond(); time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %v", what)
+		}
+	}
+}
@@ -0,0 +1,239 @@
+package pcapper
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Encrypted dumps (see Opts.EncryptionKey) are a sequence of records, each of
+// which holds a chunk of the pcapng file:
+//
+//	1 byte     format version, currently 2
+//	1 byte     flags, 1 if this is the last record of a dump
+//	8 bytes    random ID of the dump, the same for all of its records
+//	4 bytes    big-endian index of the record within its dump, from 0
+//	4 bytes    big-endian length n of the sealed chunk, at most 64 KiB plus
+//	           the tag
+//	12 bytes   random nonce
+//	n bytes    the chunk sealed with AES-GCM under the key and nonce, followed
+//	           by the 16 byte authentication tag, which n includes
+//
+// The first 18 bytes are authenticated as additional data, so records that
+// were reordered, duplicated or dropped within a dump, or swapped in from
+// another dump, fail to decrypt, and so does a dump cut short before its last
+// record. Decrypting the records in order and concatenating the chunks yields
+// the pcapng file. Each dump starts over at index 0, so dumps are appended to
+// encrypted files just like to plain ones, one pcapng section each. Dumps
+// stand on their own, though, so whole dumps that were dropped from a file or
+// moved around in it go unnoticed. Decrypt implements this.
+const (
+	encryptedVersion      = 2
+	encryptedChunkSize    = 64 * 1024
+	encryptedDumpID       = 8
+	encryptedRecordHeader = 1 + 1 + encryptedDumpID + 4 + 4 + 12
+	encryptedAAD          = 1 + 1 + encryptedDumpID + 4 + 4
+
+	encryptedLastRecord = 1
+)
+
+// encryptedRecord is the header of a record.
+type encryptedRecord [encryptedRecordHeader]byte
+
+func (r *encryptedRecord) last() bool     { return r[1]&encryptedLastRecord != 0 }
+func (r *encryptedRecord) dumpID() []byte { return r[2:10] }
+func (r *encryptedRecord) index() uint32  { return binary.BigEndian.Uint32(r[10:14]) }
+func (r *encryptedRecord) length() int64  { return int64(binary.BigEndian.Uint32(r[14:18])) }
+func (r *encryptedRecord) nonce() []byte  { return r[18:] }
+func (r *encryptedRecord) aad() []byte    { return r[:encryptedAAD] }
+
+// check verifies that r is a well-formed header of the record expected at
+// index of the dump with the given ID, which any dump matches at index 0.
+func (r *encryptedRecord) check(index uint32, dumpID []byte, aead cipher.AEAD) error {
+	if r[0] != encryptedVersion {
+		return fmt.Errorf("unsupported record format version %d", r[0])
+	}
+	if r.index() != index {
+		return fmt.Errorf("record %d of a dump found where record %d was expected, records may have been reordered, duplicated or dropped", r.index(), index)
+	}
+	if index > 0 && !bytes.Equal(r.dumpID(), dumpID) {
+		return fmt.Errorf("record %d belongs to another dump, records may have been swapped between dumps", index)
+	}
+	if length := r.length(); length < int64(aead.Overhead()) || length > int64(encryptedChunkSize+aead.Overhead()) {
+		return fmt.Errorf("invalid record length %d", length)
+	}
+	return nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Decrypt decrypts an encrypted dump read from src with key and writes the
+// resulting pcapng file to dst. It fails if records have been tampered with,
+// or reordered, duplicated, dropped or swapped in from another dump, or if a
+// dump is cut short, in which case what was decrypted up to that point has
+// already been written to dst. It can't tell if whole dumps are missing.
+func Decrypt(dst io.Writer, src io.Reader, key []byte) error {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return err
+	}
+	var header encryptedRecord
+	var dumpID [encryptedDumpID]byte
+	index := uint32(0)
+	for {
+		if _, err := io.ReadFull(src, header[:]); err != nil {
+			if err == io.EOF {
+				if index > 0 {
+					return errors.New("ends in the middle of a dump, it may be truncated")
+				}
+				return nil
+			}
+			return err
+		}
+		if err := header.check(index, dumpID[:], aead); err != nil {
+			return err
+		}
+		copy(dumpID[:], header.dumpID())
+		sealed := make([]byte, header.length())
+		if _, err := io.ReadFull(src, sealed); err != nil {
+			return err
+		}
+		chunk, err := aead.Open(sealed[:0], header.nonce(), sealed, header.aad())
+		if err != nil {
+			return err
+		}
+		if _, err := dst.Write(chunk); err != nil {
+			return err
+		}
+		index++
+		if header.last() {
+			index = 0
+		}
+	}
+}
+
+// encryptingWriter encrypts what's written to it into the records of a dump
+// on w. Data is sealed once a chunk is full and on Flush, and Close seals the
+// last record.
+type encryptingWriter struct {
+	w      io.Writer
+	aead   cipher.AEAD
+	buf    []byte
+	dumpID [encryptedDumpID]byte
+	index  uint32 // of the next record
+}
+
+func newEncryptingWriter(w io.Writer, aead cipher.AEAD) *encryptingWriter {
+	return &encryptingWriter{w: w, aead: aead, buf: make([]byte, 0, encryptedChunkSize)}
+}
+
+func (ew *encryptingWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := copy(ew.buf[len(ew.buf):cap(ew.buf)], p)
+		ew.buf = ew.buf[:len(ew.buf)+n]
+		p = p[n:]
+		written += n
+		if len(ew.buf) == cap(ew.buf) {
+			if err := ew.Flush(); err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+// Flush seals any buffered data into a record.
+func (ew *encryptingWriter) Flush() error {
+	if len(ew.buf) == 0 {
+		return nil
+	}
+	return ew.seal(0)
+}
+
+// Close seals any buffered data into the last record of the dump, which is
+// written even if it's empty, so that Decrypt can tell that the dump is
+// complete. The writer must not be used afterwards.
+func (ew *encryptingWriter) Close() error {
+	return ew.seal(encryptedLastRecord)
+}
+
+func (ew *encryptingWriter) seal(flags byte) error {
+	if ew.index == 0 {
+		if _, err := rand.Read(ew.dumpID[:]); err != nil {
+			return err
+		}
+	}
+	var header encryptedRecord
+	header[0] = encryptedVersion
+	header[1] = flags
+	copy(header.dumpID(), ew.dumpID[:])
+	binary.BigEndian.PutUint32(header[10:14], ew.index)
+	binary.BigEndian.PutUint32(header[14:18], uint32(len(ew.buf)+ew.aead.Overhead()))
+	if _, err := rand.Read(header.nonce()); err != nil {
+		return err
+	}
+	record := append(make([]byte, 0, encryptedRecordHeader+len(ew.buf)+ew.aead.Overhead()), header[:]...)
+	record = ew.aead.Seal(record, header.nonce(), ew.buf, header.aad())
+	ew.buf = ew.buf[:0]
+	ew.index++
+	_, err := ew.w.Write(record)
+	return err
+}
+
+// checkEncryptedAppendable verifies that the encrypted file of the given size
+// consists of whole, complete dumps, so that more can be appended, and returns
+// the decrypted contents of its first record, or nil if the file is empty.
+func checkEncryptedAppendable(f io.ReaderAt, size int64, aead cipher.AEAD) ([]byte, error) {
+	var first []byte
+	var header encryptedRecord
+	var dumpID [encryptedDumpID]byte
+	index := uint32(0)
+	for offset := int64(0); offset < size; {
+		if offset+encryptedRecordHeader > size {
+			return nil, errors.New("ends in the middle of a record, it may be truncated")
+		}
+		if _, err := f.ReadAt(header[:], offset); err != nil {
+			return nil, err
+		}
+		if err := header.check(index, dumpID[:], aead); err != nil {
+			return nil, err
+		}
+		copy(dumpID[:], header.dumpID())
+		length := header.length()
+		if offset+encryptedRecordHeader+length > size {
+			return nil, errors.New("ends in the middle of a record, it may be truncated")
+		}
+		if first == nil {
+			sealed := make([]byte, length)
+			if _, err := f.ReadAt(sealed, offset+encryptedRecordHeader); err != nil {
+				return nil, err
+			}
+			chunk, err := aead.Open(sealed[:0], header.nonce(), sealed, header.aad())
+			if err != nil {
+				return nil, errors.New("unable to decrypt, it may be encrypted with a different key")
+			}
+			first = chunk
+		}
+		offset += encryptedRecordHeader + length
+		index++
+		if header.last() {
+			index = 0
+		}
+	}
+	if index > 0 {
+		return nil, errors.New("ends in the middle of a dump, it may be truncated")
+	}
+	return first, nil
+}
@@ -0,0 +1,118 @@
+package pcapper
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+var testKey = bytes.Repeat([]byte{7}, 32)
+
+// encryptDumps encrypts each of dumps as a dump of its own, one after the
+// other, returning the records of all of them, and the plaintext they decrypt
+// to.
+func encryptDumps(t *testing.T, dumps ...[]byte) ([][]byte, []byte) {
+	t.Helper()
+	aead, err := newAEAD(testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var records [][]byte
+	var plain []byte
+	for _, dump := range dumps {
+		var out bytes.Buffer
+		ew := newEncryptingWriter(&out, aead)
+		if _, err := ew.Write(dump); err != nil {
+			t.Fatal(err)
+		}
+		if err := ew.Close(); err != nil {
+			t.Fatal(err)
+		}
+		for b := out.Bytes(); len(b) > 0; {
+			var header encryptedRecord
+			copy(header[:], b)
+			n := encryptedRecordHeader + int(header.length())
+			records = append(records, b[:n])
+			b = b[n:]
+		}
+		plain = append(plain, dump...)
+	}
+	return records, plain
+}
+
+func TestDecrypt(t *testing.T) {
+	// Three records, two of them full, then a dump in a single record
+	records, plain := encryptDumps(t, bytes.Repeat([]byte{1}, 2*encryptedChunkSize+10), []byte{2, 3})
+	if len(records) != 4 {
+		t.Fatalf("expected 4 records, got %d", len(records))
+	}
+	var decrypted bytes.Buffer
+	if err := Decrypt(&decrypted, bytes.NewReader(bytes.Join(records, nil)), testKey); err != nil {
+		t.Fatalf("Unable to decrypt: %v", err)
+	}
+	if !bytes.Equal(decrypted.Bytes(), plain) {
+		t.Fatal("decrypted dumps differ from the original")
+	}
+	aead, _ := newAEAD(testKey)
+	file := bytes.Join(records, nil)
+	if _, err := checkEncryptedAppendable(bytes.NewReader(file), int64(len(file)), aead); err != nil {
+		t.Fatalf("expected complete dumps to be appendable: %v", err)
+	}
+}
+
+func TestDecryptTampered(t *testing.T) {
+	records, _ := encryptDumps(t, bytes.Repeat([]byte{1}, 2*encryptedChunkSize+10))
+	oversized := append([]byte(nil), records[0]...)
+	binary.BigEndian.PutUint32(oversized[14:18], 1<<30)
+	tests := []struct {
+		name    string
+		records [][]byte
+	}{
+		{"reordered", [][]byte{records[1], records[0], records[2]}},
+		{"duplicated", [][]byte{records[0], records[0], records[1], records[2]}},
+		{"dropped", [][]byte{records[0], records[2]}},
+		{"truncated", [][]byte{records[0], records[1]}},
+		{"oversized", [][]byte{oversized, records[1], records[2]}},
+	}
+	aead, _ := newAEAD(testKey)
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			file := bytes.Join(test.records, nil)
+			var decrypted bytes.Buffer
+			if err := Decrypt(&decrypted, bytes.NewReader(file), testKey); err == nil {
+				t.Fatal("expected decrypting to fail")
+			}
+			if _, err := checkEncryptedAppendable(bytes.NewReader(file), int64(len(file)), aead); err == nil {
+				t.Fatal("expected the file not to be appendable")
+			}
+		})
+	}
+}
+
+func TestDecryptSplicedDumps(t *testing.T) {
+	// Two dumps of three records each, appended to one file
+	records, _ := encryptDumps(t, bytes.Repeat([]byte{1}, 2*encryptedChunkSize+10), bytes.Repeat([]byte{2}, 2*encryptedChunkSize+10))
+	if len(records) != 6 {
+		t.Fatalf("expected 6 records, got %d", len(records))
+	}
+	tests := []struct {
+		name    string
+		records [][]byte
+	}{
+		{"middle record", [][]byte{records[0], records[4], records[2], records[3], records[4], records[5]}},
+		{"last record", [][]byte{records[0], records[1], records[5], records[3], records[4], records[5]}},
+	}
+	aead, _ := newAEAD(testKey)
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			file := bytes.Join(test.records, nil)
+			var decrypted bytes.Buffer
+			if err := Decrypt(&decrypted, bytes.NewReader(file), testKey); err == nil {
+				t.Fatal("expected decrypting to fail")
+			}
+			if _, err := checkEncryptedAppendable(bytes.NewReader(file), int64(len(file)), aead); err == nil {
+				t.Fatal("expected the file not to be appendable")
+			}
+		})
+	}
+}
@@ -0,0 +1,85 @@
+package pcapper
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Defaults for the settings read by OptsFromEnv.
+const (
+	DefaultEnvDir          = "."
+	DefaultEnvNumIPs       = 1000
+	DefaultEnvPacketsPerIP = 1000
+	DefaultEnvSnapLen      = 65535
+	DefaultEnvTimeout      = 250 * time.Millisecond
+)
+
+// OptsFromEnv reads capture options from these environment variables, which
+// suits running in a container configured by an orchestrator:
+//
+//	PCAPPER_APPLICATION     Opts.Application
+//	PCAPPER_INTERFACE       Opts.Interface, required
+//	PCAPPER_DIR             Opts.Dir, DefaultEnvDir if unset
+//	PCAPPER_NUM_IPS         Opts.NumIPs, DefaultEnvNumIPs if unset
+//	PCAPPER_PACKETS_PER_IP  Opts.PacketsPerIP, DefaultEnvPacketsPerIP if unset
+//	PCAPPER_SNAPLEN         Opts.SnapLen, DefaultEnvSnapLen if unset
+//	PCAPPER_TIMEOUT         Opts.Timeout as a duration like "250ms",
+//	                        DefaultEnvTimeout if unset
+//	PCAPPER_FILTER          Opts.Filter
+//
+// Other options can be set on the result before starting capture.
+func OptsFromEnv() (*Opts, error) {
+	opts := &Opts{
+		Application: os.Getenv("PCAPPER_APPLICATION"),
+		Interface:   os.Getenv("PCAPPER_INTERFACE"),
+		Dir:         os.Getenv("PCAPPER_DIR"),
+		Filter:      os.Getenv("PCAPPER_FILTER"),
+	}
+	if opts.Interface == "" {
+		return nil, fmt.Errorf("PCAPPER_INTERFACE is not set")
+	}
+	if opts.Dir == "" {
+		opts.Dir = DefaultEnvDir
+	}
+	var err error
+	if opts.NumIPs, err = intFromEnv("PCAPPER_NUM_IPS", DefaultEnvNumIPs); err != nil {
+		return nil, err
+	}
+	if opts.PacketsPerIP, err = intFromEnv("PCAPPER_PACKETS_PER_IP", DefaultEnvPacketsPerIP); err != nil {
+		return nil, err
+	}
+	if opts.SnapLen, err = intFromEnv("PCAPPER_SNAPLEN", DefaultEnvSnapLen); err != nil {
+		return nil, err
+	}
+	opts.Timeout = DefaultEnvTimeout
+	if value := os.Getenv("PCAPPER_TIMEOUT"); value != "" {
+		if opts.Timeout, err = time.ParseDuration(value); err != nil {
+			return nil, fmt.Errorf("invalid PCAPPER_TIMEOUT %v: %v", value, err)
+		}
+	}
+	return opts, nil
+}
+
+// StartCapturingFromEnv is like StartCapturingWithOpts with the options read
+// by OptsFromEnv.
+func StartCapturingFromEnv() error {
+	opts, err := OptsFromEnv()
+	if err != nil {
+		return err
+	}
+	return StartCapturingWithOpts(opts)
+}
+
+func intFromEnv(name string, defaultValue int) (int, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return defaultValue, nil
+	}
+	i, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %v %v: %v", name, value, err)
+	}
+	return i, nil
+}
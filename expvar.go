@@ -0,0 +1,31 @@
+package pcapper
+
+import (
+	"expvar"
+	"sync"
+)
+
+var publishExpvarOnce sync.Once
+
+// PublishExpvar publishes the core counters from GetStats and the status from
+// GetStatus through expvar under the name "pcapper", so that they can be
+// scraped from /debug/vars without any further dependencies. The numbers are
+// read when scraped, so they always agree with GetStats. It's safe to call more
+// than once.
+func PublishExpvar() {
+	publishExpvarOnce.Do(func() {
+		expvar.Publish("pcapper", expvar.Func(func() interface{} {
+			stats := GetStats()
+			return map[string]interface{}{
+				"status":           GetStatus().String(),
+				"packetsSeen":      stats.PacketsSeen,
+				"packetsKept":      stats.PacketsKept,
+				"packetsMalformed": stats.PacketsMalformed,
+				"packetsReceived":  stats.PacketsReceived,
+				"packetsDropped":   stats.PacketsDropped,
+				"packetsIfDropped": stats.PacketsIfDropped,
+				"activeIPs":        stats.ActiveIPs,
+			}
+		}))
+	})
+}
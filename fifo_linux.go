@@ -0,0 +1,36 @@
+package pcapper
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// isFIFO reports whether the named file is a named pipe.
+func isFIFO(name string) bool {
+	info, err := os.Stat(name)
+	return err == nil && info.Mode()&os.ModeNamedPipe != 0
+}
+
+// openFIFO opens the named pipe for writing. Opening it non-blocking makes
+// this fail unless some process has it open for reading, as nobody would see
+// the packets otherwise. Writes still block until the reader catches up.
+func openFIFO(name string) (*os.File, error) {
+	file, err := os.OpenFile(name, os.O_WRONLY|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		if errors.Is(err, syscall.ENXIO) {
+			return nil, log.Errorf("Unable to open pipe %v, nothing is reading from it", name)
+		}
+		return nil, log.Errorf("Unable to open pipe %v: %v", name, err)
+	}
+	return file, nil
+}
+
+// describeWriteError explains errors writing to name, where a broken pipe just
+// means that the reader of a FIFO went away.
+func describeWriteError(name string, err error) string {
+	if errors.Is(err, syscall.EPIPE) {
+		return "the process reading from " + name + " went away"
+	}
+	return err.Error()
+}
@@ -0,0 +1,255 @@
+package pcapper
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// Flow logs (see DumpFormatFlows) start with the 4 byte magic "PCFL" and a
+// version byte, currently 1, followed by a record per flow. All integers are
+// little-endian, like in our pcapng files. A record is
+//
+//	2 bytes    length n of the rest of the record
+//	1 byte     IP version, 4 or 6
+//	1 byte     IP protocol, e.g. 6 for TCP
+//	4/16 bytes source IP
+//	4/16 bytes destination IP
+//	2 bytes    source port, 0 unless TCP or UDP
+//	2 bytes    destination port, 0 unless TCP or UDP
+//	4 bytes    number of packets
+//	8 bytes    number of bytes, as on the wire
+//	8 bytes    timestamp of the first packet, in nanoseconds since the epoch
+//	8 bytes    timestamp of the last packet, likewise
+//
+// Readers must skip whatever follows these fields within n, which leaves room
+// for adding fields. Each dump appends its flows to the file, so a flow may
+// appear in several records. ReadFlowLog implements this.
+const flowLogVersion = 1
+
+var flowLogMagic = []byte("PCFL")
+
+// FlowRecord summarizes the packets of a flow, one direction of a
+// conversation, in a flow log.
+type FlowRecord struct {
+	SrcIP    net.IP
+	DstIP    net.IP
+	Protocol layers.IPProtocol
+	SrcPort  uint16
+	DstPort  uint16
+	Packets  int
+	Bytes    int
+	First    time.Time
+	Last     time.Time
+}
+
+type flowKey struct {
+	src, dst string
+	protocol layers.IPProtocol
+	srcPort  uint16
+	dstPort  uint16
+}
+
+// flowKeyOf returns the key of the flow that packet belongs to, or false if it
+// has no IP layer. Packets other than TCP and UDP have no ports.
+func flowKeyOf(packet gopacket.Packet) (flowKey, bool) {
+	var key flowKey
+	switch t := packet.NetworkLayer().(type) {
+	case *layers.IPv4:
+		key.src, key.dst, key.protocol = string(t.SrcIP), string(t.DstIP), t.Protocol
+	case *layers.IPv6:
+		key.src, key.dst, key.protocol = string(t.SrcIP), string(t.DstIP), ipv6Protocol(packet, t)
+	default:
+		return key, false
+	}
+	switch t := packet.TransportLayer().(type) {
+	case *layers.TCP:
+		key.srcPort, key.dstPort = uint16(t.SrcPort), uint16(t.DstPort)
+	case *layers.UDP:
+		key.srcPort, key.dstPort = uint16(t.SrcPort), uint16(t.DstPort)
+	}
+	return key, true
+}
+
+// ipv6Protocol returns the protocol of the payload of ip, a layer of packet,
+// which is the next header of the last of its extension headers, if it has
+// any, rather than the next header of ip itself.
+func ipv6Protocol(packet gopacket.Packet, ip *layers.IPv6) layers.IPProtocol {
+	protocol := ip.NextHeader
+	after := false
+	for _, layer := range packet.Layers() {
+		if !after {
+			after = layer == gopacket.Layer(ip)
+			continue
+		}
+		switch ext := layer.(type) {
+		case *layers.IPv6HopByHop:
+			protocol = ext.NextHeader
+		case *layers.IPv6Routing:
+			protocol = ext.NextHeader
+		case *layers.IPv6Destination:
+			protocol = ext.NextHeader
+		case *layers.IPv6Fragment:
+			protocol = ext.NextHeader
+		default:
+			return protocol
+		}
+	}
+	return protocol
+}
+
+// buildFlows summarizes packets as flows, in the order in which the flows were
+// first seen. Packets without an IP layer are left out.
+func buildFlows(packets []gopacket.Packet) []*FlowRecord {
+	var flows []*FlowRecord
+	byKey := make(map[flowKey]*FlowRecord)
+	for _, packet := range packets {
+		key, ok := flowKeyOf(packet)
+		if !ok {
+			continue
+		}
+		md := packet.Metadata()
+		flow := byKey[key]
+		if flow == nil {
+			flow = &FlowRecord{
+				SrcIP:    net.IP(key.src),
+				DstIP:    net.IP(key.dst),
+				Protocol: key.protocol,
+				SrcPort:  key.srcPort,
+				DstPort:  key.dstPort,
+				First:    md.Timestamp,
+				Last:     md.Timestamp,
+			}
+			byKey[key] = flow
+			flows = append(flows, flow)
+		}
+		flow.Packets++
+		flow.Bytes += md.Length
+		if md.Timestamp.Before(flow.First) {
+			flow.First = md.Timestamp
+		}
+		if md.Timestamp.After(flow.Last) {
+			flow.Last = md.Timestamp
+		}
+	}
+	return flows
+}
+
+// writeFlowLogHeader writes the header that starts a flow log.
+func writeFlowLogHeader(w io.Writer) error {
+	_, err := w.Write(append(append([]byte(nil), flowLogMagic...), flowLogVersion))
+	return err
+}
+
+// checkFlowLog checks that the file read by r starts like a flow log.
+func checkFlowLog(r io.Reader) error {
+	header := make([]byte, len(flowLogMagic)+1)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return fmt.Errorf("unable to read flow log header: %v", err)
+	}
+	if !bytes.Equal(header[:len(flowLogMagic)], flowLogMagic) {
+		return errors.New("not a flow log")
+	}
+	if header[len(flowLogMagic)] != flowLogVersion {
+		return fmt.Errorf("unsupported flow log version %d", header[len(flowLogMagic)])
+	}
+	return nil
+}
+
+// writeFlowRecords writes flows as records of a flow log.
+func writeFlowRecords(w io.Writer, flows []*FlowRecord) error {
+	var b []byte
+	for _, flow := range flows {
+		version, src, dst := byte(6), flow.SrcIP.To16(), flow.DstIP.To16()
+		if src4, dst4 := flow.SrcIP.To4(), flow.DstIP.To4(); src4 != nil && dst4 != nil {
+			version, src, dst = 4, src4, dst4
+		}
+		record := make([]byte, 2, 2+2+2*len(src)+4+4+8+8+8)
+		record = append(record, version, byte(flow.Protocol))
+		record = append(record, src...)
+		record = append(record, dst...)
+		record = appendUint16(record, flow.SrcPort)
+		record = appendUint16(record, flow.DstPort)
+		record = appendUint32(record, uint32(flow.Packets))
+		record = appendUint64(record, uint64(flow.Bytes))
+		record = appendUint64(record, uint64(flow.First.UnixNano()))
+		record = appendUint64(record, uint64(flow.Last.UnixNano()))
+		binary.LittleEndian.PutUint16(record, uint16(len(record)-2))
+		b = append(b, record...)
+	}
+	_, err := w.Write(b)
+	return err
+}
+
+// ReadFlowLog reads all records of a flow log written with DumpFormatFlows.
+func ReadFlowLog(r io.Reader) ([]*FlowRecord, error) {
+	br := bufio.NewReader(r)
+	if err := checkFlowLog(br); err != nil {
+		return nil, err
+	}
+	var flows []*FlowRecord
+	var length [2]byte
+	for {
+		if _, err := io.ReadFull(br, length[:]); err != nil {
+			if err == io.EOF {
+				return flows, nil
+			}
+			return flows, fmt.Errorf("truncated flow record: %v", err)
+		}
+		record := make([]byte, binary.LittleEndian.Uint16(length[:]))
+		if _, err := io.ReadFull(br, record); err != nil {
+			return flows, fmt.Errorf("truncated flow record: %v", err)
+		}
+		flow, err := parseFlowRecord(record)
+		if err != nil {
+			return flows, err
+		}
+		flows = append(flows, flow)
+	}
+}
+
+func parseFlowRecord(record []byte) (*FlowRecord, error) {
+	if len(record) < 2 {
+		return nil, errors.New("flow record too short")
+	}
+	ipLen := 16
+	if record[0] == 4 {
+		ipLen = 4
+	} else if record[0] != 6 {
+		return nil, fmt.Errorf("invalid IP version %d in flow record", record[0])
+	}
+	if len(record) < 2+2*ipLen+4+4+8+8+8 {
+		return nil, errors.New("flow record too short")
+	}
+	flow := &FlowRecord{Protocol: layers.IPProtocol(record[1])}
+	b := record[2:]
+	flow.SrcIP, b = net.IP(append([]byte(nil), b[:ipLen]...)), b[ipLen:]
+	flow.DstIP, b = net.IP(append([]byte(nil), b[:ipLen]...)), b[ipLen:]
+	flow.SrcPort = binary.LittleEndian.Uint16(b[0:])
+	flow.DstPort = binary.LittleEndian.Uint16(b[2:])
+	flow.Packets = int(binary.LittleEndian.Uint32(b[4:]))
+	flow.Bytes = int(binary.LittleEndian.Uint64(b[8:]))
+	flow.First = time.Unix(0, int64(binary.LittleEndian.Uint64(b[16:])))
+	flow.Last = time.Unix(0, int64(binary.LittleEndian.Uint64(b[24:])))
+	return flow, nil
+}
+
+func appendUint16(b []byte, v uint16) []byte {
+	var buf [2]byte
+	binary.LittleEndian.PutUint16(buf[:], v)
+	return append(b, buf[:]...)
+}
+
+func appendUint64(b []byte, v uint64) []byte {
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], v)
+	return append(b, buf[:]...)
+}
@@ -0,0 +1,82 @@
+package pcapper
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+var (
+	testDstIPv4 = net.IP{198, 18, 0, 7}
+	testDstIPv6 = net.ParseIP("2001:db8::7")
+)
+
+// testFrame serializes an Ethernet frame of type etherType with the given
+// layers on top and decodes it into a packet timestamped at ts.
+func testFrame(t *testing.T, ts time.Time, etherType layers.EthernetType, ls ...gopacket.SerializableLayer) gopacket.Packet {
+	t.Helper()
+	eth := &layers.Ethernet{SrcMAC: syntheticMAC, DstMAC: syntheticMAC, EthernetType: etherType}
+	buf := gopacket.NewSerializeBuffer()
+	if err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true}, append([]gopacket.SerializableLayer{eth}, ls...)...); err != nil {
+		t.Fatalf("Unable to serialize frame: %v", err)
+	}
+	data := append([]byte(nil), buf.Bytes()...)
+	packet := gopacket.NewPacket(data, layers.LayerTypeEthernet, gopacket.Default)
+	md := packet.Metadata()
+	md.Timestamp = ts
+	md.CaptureLength = len(data)
+	md.Length = len(data)
+	return packet
+}
+
+// rawIPv6 returns the bytes of an IPv6 header from syntheticSrcIPv6 to
+// testDstIPv6 whose next header is nextHeader, followed by payload, which
+// starts with any extension headers.
+func rawIPv6(nextHeader layers.IPProtocol, payload ...byte) gopacket.Payload {
+	b := make([]byte, 40, 40+len(payload))
+	b[0] = 6 << 4
+	binary.BigEndian.PutUint16(b[4:], uint16(len(payload)))
+	b[6] = byte(nextHeader)
+	b[7] = 64
+	copy(b[8:], syntheticSrcIPv6)
+	copy(b[24:], testDstIPv6)
+	return append(b, payload...)
+}
+
+// testUDP is a UDP header from port 10000 to 53 with 4 bytes of payload.
+var testUDP = []byte{0x27, 0x10, 0x00, 0x35, 0x00, 0x0c, 0x00, 0x00, 1, 2, 3, 4}
+
+func TestFlowKeyOfIPv6ExtensionHeaders(t *testing.T) {
+	hopByHop := append([]byte{byte(layers.IPProtocolUDP), 0, 1, 4, 0, 0, 0, 0}, testUDP...)
+	// Hop-by-hop options, then a fragment header, then UDP
+	hopByHopFragment := append([]byte{byte(layers.IPProtocolIPv6Fragment), 0, 1, 4, 0, 0, 0, 0,
+		byte(layers.IPProtocolUDP), 0, 0x00, 0x01, 0, 0, 0, 42}, testUDP...)
+	tests := []struct {
+		name    string
+		payload gopacket.Payload
+		ports   bool
+	}{
+		{"none", rawIPv6(layers.IPProtocolUDP, testUDP...), true},
+		{"hop-by-hop", rawIPv6(layers.IPProtocolIPv6HopByHop, hopByHop...), true},
+		// gopacket doesn't decode the payload of fragments, even of the first
+		{"hop-by-hop and fragment", rawIPv6(layers.IPProtocolIPv6HopByHop, hopByHopFragment...), false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			key, ok := flowKeyOf(testFrame(t, time.Now(), layers.EthernetTypeIPv6, test.payload))
+			if !ok {
+				t.Fatal("expected a flow key")
+			}
+			if key.protocol != layers.IPProtocolUDP {
+				t.Fatalf("expected a UDP flow, got protocol %v", key.protocol)
+			}
+			if test.ports && (key.srcPort != 10000 || key.dstPort != 53) {
+				t.Fatalf("expected a flow from port 10000 to 53, got from port %d to %d", key.srcPort, key.dstPort)
+			}
+		})
+	}
+}
@@ -0,0 +1,24 @@
+package pcapper
+
+import (
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// gtpInnerLayer returns the IP layer that a GTP-U packet carries, or nil if
+// packet isn't GTP-U or carries no user data. gopacket decodes GTP-U on UDP port
+// 2152 by itself, so the layers after it are those of the tunneled packet.
+func gtpInnerLayer(packet gopacket.Packet) gopacket.NetworkLayer {
+	tunneled := false
+	for _, layer := range packet.Layers() {
+		switch layer.LayerType() {
+		case layers.LayerTypeGTPv1U:
+			tunneled = true
+		case layers.LayerTypeIPv4, layers.LayerTypeIPv6:
+			if tunneled {
+				return layer.(gopacket.NetworkLayer)
+			}
+		}
+	}
+	return nil
+}
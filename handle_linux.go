@@ -0,0 +1,98 @@
+package pcapper
+
+import (
+	"github.com/google/gopacket/pcap"
+)
+
+// openHandle creates, configures and activates a pcap handle for the named
+// interface, capturing up to snapLen bytes of each packet.
+func openHandle(opts *Opts, interfaceName string, snapLen int) (*pcap.Handle, error) {
+	inactive, err := pcap.NewInactiveHandle(interfaceName)
+	if err != nil {
+		return nil, log.Errorf("Unable to open %v for packet capture: %v", interfaceName, err)
+	}
+	defer inactive.CleanUp()
+	if err := inactive.SetSnapLen(snapLen); err != nil {
+		return nil, log.Errorf("Unable to set snap length for %v: %v", interfaceName, err)
+	}
+	if err := inactive.SetPromisc(false); err != nil {
+		return nil, log.Errorf("Unable to disable promiscuous mode for %v: %v", interfaceName, err)
+	}
+	if err := inactive.SetTimeout(opts.Timeout); err != nil {
+		return nil, log.Errorf("Unable to set capture timeout for %v: %v", interfaceName, err)
+	}
+	if opts.BufferSize > 0 {
+		if err := inactive.SetBufferSize(opts.BufferSize); err != nil {
+			return nil, log.Errorf("Unable to set buffer size for %v: %v", interfaceName, err)
+		}
+	}
+	if opts.ImmediateMode {
+		if err := inactive.SetImmediateMode(true); err != nil {
+			return nil, log.Errorf("Unable to enable immediate mode for %v: %v", interfaceName, err)
+		}
+	}
+	if opts.MonitorMode {
+		if err := inactive.SetRFMon(true); err != nil {
+			return nil, log.Errorf("Unable to enable monitor mode for %v: %v", interfaceName, err)
+		}
+	}
+	if opts.TimestampSource != "" {
+		setTimestampSource(inactive, interfaceName, opts.TimestampSource)
+	}
+	handle, err := inactive.Activate()
+	if err != nil {
+		return nil, log.Errorf("Unable to open %v for packet capture: %v", interfaceName, err)
+	}
+	if opts.Direction != CaptureInOut {
+		if err := handle.SetDirection(pcapDirection(opts.Direction)); err != nil {
+			handle.Close()
+			return nil, log.Errorf("Unable to set capture direction on %v: %v", interfaceName, err)
+		}
+	}
+	if opts.Filter != "" {
+		if err := handle.SetBPFFilter(opts.Filter); err != nil {
+			handle.Close()
+			return nil, log.Errorf("Unable to set filter %v on %v: %v", opts.Filter, interfaceName, err)
+		}
+	}
+	return handle, nil
+}
+
+// pcapDirection returns pcap's equivalent of direction.
+func pcapDirection(direction CaptureDirection) pcap.Direction {
+	switch direction {
+	case CaptureIn:
+		return pcap.DirectionIn
+	case CaptureOut:
+		return pcap.DirectionOut
+	default:
+		return pcap.DirectionInOut
+	}
+}
+
+// setTimestampSource selects the named timestamp source on the inactive handle.
+// If the source is unknown or not supported by the interface, it logs an error
+// and leaves pcap's default source in place.
+func setTimestampSource(inactive *pcap.InactiveHandle, interfaceName string, name string) {
+	source, err := pcap.TimestampSourceFromString(name)
+	if err != nil {
+		log.Errorf("Unknown timestamp source %v, using default: %v", name, err)
+		return
+	}
+	supported := false
+	for _, s := range inactive.SupportedTimestamps() {
+		if s == source {
+			supported = true
+			break
+		}
+	}
+	if !supported {
+		log.Errorf("Timestamp source %v not supported by %v, using default", name, interfaceName)
+		return
+	}
+	if err := inactive.SetTimestampSource(source); err != nil {
+		log.Errorf("Unable to set timestamp source %v on %v, using default: %v", name, interfaceName, err)
+		return
+	}
+	log.Debugf("Using timestamp source %v on %v", name, interfaceName)
+}
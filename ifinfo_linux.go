@@ -0,0 +1,139 @@
+package pcapper
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// linkHeaderRoom is the room left in the snap length for link-layer headers
+// on top of the MTU: an Ethernet header with two VLAN tags, which is at least
+// as long as the Linux cooked header of "any".
+const linkHeaderRoom = 14 + 2*4
+
+// describeInterface describes the MTU and link speed of the named interface,
+// for example "mtu 1500, speed 1000 Mb/s", or returns "" if neither is known,
+// as for virtual interfaces and "any".
+//
+// pcapng has an if_speed option, but pcapgo doesn't write it and has no option
+// for the MTU at all, so both go into the interface's description.
+func describeInterface(name string) string {
+	var parts []string
+	if mtu := interfaceMTU(name); mtu > 0 {
+		parts = append(parts, fmt.Sprintf("mtu %d", mtu))
+	}
+	if speed := linkSpeed(name); speed > 0 {
+		parts = append(parts, fmt.Sprintf("speed %d Mb/s", speed))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// interfaceMTU returns the MTU of the named interface, or 0 if it's unknown.
+// For "any", it's the largest MTU of all interfaces.
+func interfaceMTU(name string) int {
+	if name == "any" {
+		intfs, err := net.Interfaces()
+		if err != nil {
+			return 0
+		}
+		mtu := 0
+		for _, intf := range intfs {
+			if intf.MTU > mtu {
+				mtu = intf.MTU
+			}
+		}
+		return mtu
+	}
+	intf, err := net.InterfaceByName(name)
+	if err != nil || intf.MTU < 0 {
+		return 0
+	}
+	return intf.MTU
+}
+
+// checkSnapLen derives the snap length from the MTUs of the interfaces with
+// Opts.AutoSnapLen. Otherwise, it warns about interfaces whose full frames
+// don't fit into Opts.SnapLen, as they'd be truncated.
+func (c *capturer) checkSnapLen() {
+	names := c.opts.Interfaces
+	if len(names) == 0 {
+		names = []string{c.opts.Interface}
+	}
+	largest := 0
+	for _, name := range names {
+		mtu := interfaceMTU(name)
+		if mtu == 0 {
+			continue
+		}
+		if mtu > largest {
+			largest = mtu
+		}
+		// A snap length of 0 leaves it to pcap, which captures whole packets
+		if !c.opts.AutoSnapLen && c.snapLen > 0 && c.snapLen < mtu+linkHeaderRoom {
+			log.Errorf("Snap length %d is shorter than full frames on %v, whose MTU is %d, so they may be truncated", c.snapLen, name, mtu)
+		}
+	}
+	if !c.opts.AutoSnapLen {
+		return
+	}
+	if largest == 0 {
+		log.Debugf("MTU of %v unknown, using snap length %d", strings.Join(names, ","), c.snapLen)
+		return
+	}
+	c.snapLen = largest + linkHeaderRoom
+	log.Debugf("Using snap length %d for MTU %d", c.snapLen, largest)
+}
+
+// linkSpeed returns the link speed of the named interface in Mb/s as reported
+// by sysfs, or 0 if it's unknown. Reading it fails while the link is down, and
+// virtual interfaces report -1.
+func linkSpeed(name string) int {
+	b, err := ioutil.ReadFile(filepath.Join("/sys/class/net", name, "speed"))
+	if err != nil {
+		return 0
+	}
+	speed, err := strconv.Atoi(strings.TrimSpace(string(b)))
+	if err != nil || speed < 0 {
+		return 0
+	}
+	return speed
+}
+
+// interfaceLabel returns the name recorded for interfaceName in pcapng files,
+// labelling each of the names of merged interfaces (see Opts.InterfaceLabels).
+func (c *capturer) interfaceLabel(interfaceName string) string {
+	if len(c.opts.InterfaceLabels) == 0 {
+		return interfaceName
+	}
+	names := strings.Split(interfaceName, ",")
+	for i, name := range names {
+		if label, found := c.opts.InterfaceLabels[name]; found {
+			names[i] = label
+		}
+	}
+	return strings.Join(names, ",")
+}
+
+// interfaceDescription returns the description recorded for interfaceName in
+// pcapng files. For the merged interfaces of Opts.Interfaces, whose names are
+// joined by commas, it describes each of them.
+func (c *capturer) interfaceDescription(interfaceName string) string {
+	if len(c.sources) == 1 || c.opts.SeparateInterfaces {
+		for _, src := range c.sources {
+			if src.name == interfaceName {
+				return src.description
+			}
+		}
+		return ""
+	}
+	var parts []string
+	for _, src := range c.sources {
+		if src.description != "" {
+			parts = append(parts, c.interfaceLabel(src.name)+": "+src.description)
+		}
+	}
+	return strings.Join(parts, "; ")
+}
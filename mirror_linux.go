@@ -0,0 +1,111 @@
+package pcapper
+
+import (
+	"io"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/gopacket"
+)
+
+// mirrorCloseTimeout is how long stopping waits for the mirror to write out
+// its queue before giving up on it.
+const mirrorCloseTimeout = time.Second
+
+// mirror streams kept packets to Opts.Mirror as pcapng. Packets are queued for
+// a goroutine of its own, so a slow mirror drops packets rather than holding
+// up capture.
+type mirror struct {
+	packets chan mirroredPacket
+	done    chan struct{}
+	w       io.Writer
+	dropped int64 // accessed atomically
+}
+
+// mirroredPacket is what's written to the mirror for a packet, worked out on
+// the capture goroutine, which owns the packet and its lazily decoded layers.
+type mirroredPacket struct {
+	ci   gopacket.CaptureInfo
+	data []byte
+}
+
+// startMirror starts streaming to Opts.Mirror, or returns nil if it isn't set.
+func (c *capturer) startMirror() *mirror {
+	if c.opts.Mirror == nil {
+		return nil
+	}
+	queueLen := c.opts.MirrorQueueLen
+	if queueLen <= 0 {
+		queueLen = DefaultMirrorQueueLen
+	}
+	m := &mirror{
+		packets: make(chan mirroredPacket, queueLen),
+		done:    make(chan struct{}),
+		w:       c.opts.Mirror,
+	}
+	// Created here rather than on the mirror's goroutine, as c.linkType
+	// belongs to the capture goroutine
+	pcaps, err := c.newPcapWriter(c.opts.Mirror, c.interfaceNames(), "", uint32(c.snapLen))
+	if err != nil {
+		reportError(log.Errorf("Unable to start mirror: %v", err))
+	}
+	go func() {
+		defer close(m.done)
+		for packet := range m.packets {
+			if pcaps == nil {
+				// Broken, so just drain the queue
+				atomic.AddInt64(&m.dropped, 1)
+				continue
+			}
+			if err := pcaps.WritePacket(packet.ci, packet.data); err != nil {
+				reportError(log.Errorf("Error writing to mirror, no longer mirroring: %v", err))
+				pcaps = nil
+				continue
+			}
+			if len(m.packets) == 0 {
+				// Caught up, so pass on what we have
+				if err := pcaps.Flush(); err != nil {
+					reportError(log.Errorf("Error flushing mirror, no longer mirroring: %v", err))
+					pcaps = nil
+				}
+			}
+		}
+		if pcaps != nil {
+			pcaps.Flush()
+		}
+	}()
+	return m
+}
+
+// add queues the capture info and data of a packet for the mirror, or drops
+// them if the queue is full.
+func (m *mirror) add(ci gopacket.CaptureInfo, data []byte) {
+	select {
+	case m.packets <- mirroredPacket{ci, data}:
+	default:
+		atomic.AddInt64(&m.dropped, 1)
+	}
+}
+
+// close writes out the queued packets and stops the mirror. If the mirror
+// doesn't catch up within mirrorCloseTimeout, it closes Opts.Mirror if it's an
+// io.Closer, to unblock the pending write, and gives up on the mirror.
+func (m *mirror) close() {
+	close(m.packets)
+	select {
+	case <-m.done:
+		return
+	case <-time.After(mirrorCloseTimeout):
+	}
+	closer, ok := m.w.(io.Closer)
+	if !ok {
+		reportError(log.Errorf("Mirror didn't finish writing within %v, abandoning it", mirrorCloseTimeout))
+		return
+	}
+	reportError(log.Errorf("Mirror didn't finish writing within %v, closing it", mirrorCloseTimeout))
+	closer.Close()
+	select {
+	case <-m.done:
+	case <-time.After(mirrorCloseTimeout):
+	}
+}
@@ -0,0 +1,75 @@
+package pcapper
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"sort"
+)
+
+const (
+	ngBlockTypeNameResolution = 0x00000004
+
+	nrbRecordEnd  = 0
+	nrbRecordIPv4 = 1
+	nrbRecordIPv6 = 2
+)
+
+// writeNameResolutionBlock writes a pcapng name resolution block mapping each
+// IP in names to its name. Like pcapgo, it writes little-endian, so the block
+// matches the rest of our files. Nothing is written if names is empty.
+func writeNameResolutionBlock(w io.Writer, names map[string]string) error {
+	if len(names) == 0 {
+		return nil
+	}
+	ips := make([]string, 0, len(names))
+	for ip := range names {
+		ips = append(ips, ip)
+	}
+	// Sorted, so that the same names always produce the same block
+	sort.Strings(ips)
+
+	body := make([]byte, 0, 64*len(names))
+	for _, ip := range ips {
+		parsed := net.ParseIP(ip)
+		if parsed == nil {
+			continue
+		}
+		recordType, addr := uint16(nrbRecordIPv6), []byte(parsed.To16())
+		if ip4 := parsed.To4(); ip4 != nil {
+			recordType, addr = nrbRecordIPv4, []byte(ip4)
+		}
+		value := append(append(addr, names[ip]...), 0)
+		body = appendNRBRecord(body, recordType, value)
+	}
+	body = appendNRBRecord(body, nrbRecordEnd, nil)
+
+	length := 12 + len(body)
+	block := make([]byte, 0, length)
+	block = appendUint32(block, ngBlockTypeNameResolution)
+	block = appendUint32(block, uint32(length))
+	block = append(block, body...)
+	block = appendUint32(block, uint32(length))
+	_, err := w.Write(block)
+	return err
+}
+
+// appendNRBRecord appends a record to b, padding its value to 32 bits.
+func appendNRBRecord(b []byte, recordType uint16, value []byte) []byte {
+	var header [4]byte
+	binary.LittleEndian.PutUint16(header[0:2], recordType)
+	binary.LittleEndian.PutUint16(header[2:4], uint16(len(value)))
+	b = append(b, header[:]...)
+	b = append(b, value...)
+	for len(value)%4 != 0 {
+		b = append(b, 0)
+		value = append(value, 0)
+	}
+	return b
+}
+
+func appendUint32(b []byte, v uint32) []byte {
+	var buf [4]byte
+	binary.LittleEndian.PutUint32(buf[:], v)
+	return append(b, buf[:]...)
+}
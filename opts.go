@@ -0,0 +1,596 @@
+package pcapper
+
+import (
+	"io"
+	"net"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// DefaultNumIPs is the number of IPs that queues and the record of when IPs
+// were last dumped are sized for with Opts.NoEviction if Opts.NumIPs isn't
+// set.
+const DefaultNumIPs = 1000
+
+// DefaultDumpWorkers is the number of dumps that are written concurrently if
+// Opts.DumpWorkers isn't set.
+const DefaultDumpWorkers = 4
+
+// DefaultMirrorQueueLen is the number of packets queued for Opts.Mirror if
+// Opts.MirrorQueueLen isn't set.
+const DefaultMirrorQueueLen = 1000
+
+// DefaultFlowTableSize is the number of flows remembered with
+// Opts.FirstPacketPerFlow if Opts.FlowTableSize isn't set.
+const DefaultFlowTableSize = 100000
+
+// DefaultOverflowInterval is the minimum time between calls to Opts.OnOverflow
+// for the same buffer if Opts.OverflowInterval isn't set.
+const DefaultOverflowInterval = time.Minute
+
+// DefaultRecentDumps is the number of dump results kept for RecentDumps if
+// Opts.RecentDumps isn't set.
+const DefaultRecentDumps = 100
+
+// DefaultCatchAllKey is the key under which packets without an IP layer are
+// buffered in monitor mode if Opts.CatchAllKey isn't set.
+const DefaultCatchAllKey = "other"
+
+// Opts configures packet capture.
+type Opts struct {
+	// Application is recorded in the section header of dumped pcapng files.
+	Application string
+
+	// Interface is the name of the network interface to capture from. It is
+	// recorded as the interface of every packet in dumped files.
+	//
+	// When capturing on a bond or bridge, packets can't be attributed to the
+	// member port that carried them. libpcap doesn't pass on the index of the
+	// interface that a packet arrived on, and the AF_PACKET sockets underneath
+	// only report the member rather than the bond when the PACKET_ORIGDEV
+	// option is set, which libpcap doesn't do. To tell members apart, capture
+	// on each of them separately.
+	Interface string
+
+	// Interfaces, if set, captures from all of these interfaces at once
+	// instead of from Interface. They must all have the same link type, and
+	// Filter and Rules are applied to each. How packets from different
+	// interfaces are kept depends on SeparateInterfaces. If one of the
+	// interfaces fails, the others carry on capturing while it's reopened.
+	// A reopened interface must still have the link type that capture started
+	// with, or it isn't captured from until it does.
+	Interfaces []string
+
+	// SeparateInterfaces, when true, keeps the packets of each of Interfaces
+	// in buffers of their own and dumps them to a directory per interface,
+	// <dir>/<interface>/<ip>.pcapng, so that dumps never mix NICs. When false,
+	// packets from all interfaces are merged into the same buffers and files,
+	// which record the interfaces' names joined by commas.
+	SeparateInterfaces bool
+
+	// InterfaceLabels and InterfaceDescriptions, if set, map the names of
+	// interfaces captured from to the name and description recorded for them
+	// in pcapng interface blocks, instead of their OS name and a description of
+	// their MTU and link speed. This labels interfaces whose names mean
+	// nothing, such as virtual taps, with a friendly name. Only the files
+	// differ, directories and Interface() keep using the OS names.
+	InterfaceLabels       map[string]string
+	InterfaceDescriptions map[string]string
+
+	// Dir is the directory into which pcaps are dumped. It isn't needed with
+	// InMemory.
+	Dir string
+
+	// InMemory, when true, never writes to the filesystem, for read-only or
+	// ephemeral environments: packets can only be retrieved with DumpTo,
+	// DumpBytes and SnapshotTo. Dumps to disk, such as by Dump, DumpAll, Drain
+	// and triggers, do nothing and leave the buffers in place. It can't be
+	// combined with RollingFileSize.
+	InMemory bool
+
+	// Filter, if set, is a BPF expression in pcap-filter(7) syntax that
+	// packets must match to be captured at all, for example "not port 22". It
+	// is applied in the kernel, so packets that don't match cost nothing.
+	Filter string
+
+	// Direction selects whether packets received by the interface, packets
+	// sent by it, or both are captured. Capturing only received packets
+	// leaves out the capturing host's own traffic. The default, CaptureInOut,
+	// captures both.
+	Direction CaptureDirection
+
+	// NumIPs is the number of most recently active IPs for which packets are
+	// kept in memory. It must be at least 1, except with NoEviction.
+	NumIPs int
+
+	// PacketsPerIP is the number of packets kept in memory for each IP. It must
+	// be at least 1, except with RollingFileSize.
+	PacketsPerIP int
+
+	// BufferDuration, if positive, keeps only the last so much of each IP's
+	// traffic, so that dumps cover a known time window, such as the last 30
+	// seconds, whatever the packet rate. PacketsPerIP still caps each buffer,
+	// so it should be large enough for the busiest IP's rate over the
+	// duration. It has no effect with RollingFileSize.
+	BufferDuration time.Duration
+
+	// AllowedIPs, if not empty, restricts buffering to packets whose remote
+	// side is one of these IPs or in one of these networks, given in CIDR
+	// notation.
+	AllowedIPs []string
+
+	// NoEviction, when true, keeps buffers in a plain map rather than an LRU
+	// cache, so that no IP's buffer is ever evicted to make room for another
+	// and NumIPs only sizes queues, with DefaultNumIPs if it isn't set. This
+	// guarantees that packets are retained for a known set of hosts, which
+	// should be given in AllowedIPs: without it, every remote IP gets a buffer
+	// and memory use is unbounded. Stats list buffers in no particular order
+	// in this mode.
+	NoEviction bool
+
+	// SnapLen is the maximum length of captured packets.
+	SnapLen int
+
+	// AutoSnapLen, when true, derives the snap length from the largest MTU of
+	// the interfaces plus room for link-layer headers, so that full frames
+	// are captured, including jumbo frames on interfaces with an MTU of 9000.
+	// SnapLen is used instead if no MTU is known. Without AutoSnapLen, an
+	// error is logged when SnapLen is too short for an interface's MTU.
+	AutoSnapLen bool
+
+	// PayloadSnapLen, if positive, truncates packets to their headers plus
+	// this many bytes of payload when they're written to disk. Unlike SnapLen,
+	// which cuts every packet at the same length, this keeps all headers up to
+	// the transport layer however long they are, while still bounding the size
+	// of files. Packets whose transport layer wasn't decoded are cut after
+	// their network layer headers.
+	PayloadSnapLen int
+
+	// BufferHeadersOnly, when true, keeps only the headers of packets, cut as
+	// PayloadSnapLen cuts them but without any payload, and decodes them
+	// completely when they're kept. That way the same memory holds many more
+	// packets, and flow logs and filters on dump read the addresses, ports and
+	// flags of buffered packets without decoding them again. Dumps and rolling
+	// files then contain only the headers, along with the original length of
+	// each packet. OnPacket, Mirror and subscribers still receive the packets
+	// as captured.
+	BufferHeadersOnly bool
+
+	// TimestampOffset is added to the timestamps of packets as they're written
+	// to disk or to Mirror, for example to correct a known clock skew when
+	// correlating captures from several hosts. Buffered packets keep their
+	// original timestamps, and so do the packets passed to OnPacket and
+	// subscribers.
+	TimestampOffset time.Duration
+
+	// Timeout is the capture timeout.
+	Timeout time.Duration
+
+	// TimestampSource selects where packet timestamps come from, using pcap's
+	// names such as "host", "adapter" or "adapter_unsynced" (see
+	// pcap-tstamp(7)). Hardware ("adapter") timestamps are more accurate for
+	// latency measurements. If empty, or if the interface doesn't support the
+	// requested source, pcap's default is used.
+	TimestampSource string
+
+	// BufferSize is the size in bytes of the kernel buffer into which packets
+	// are captured. A larger buffer absorbs bursts of traffic that would
+	// otherwise be dropped. If 0, pcap's default is used.
+	BufferSize int
+
+	// ImmediateMode, when true, has pcap deliver packets as soon as they arrive
+	// instead of batching them until the capture timeout expires. This narrows
+	// the window in which a packet that was just seen isn't yet buffered.
+	ImmediateMode bool
+
+	// MonitorMode, when true, captures from a wireless interface in monitor
+	// mode, which sees all 802.11 frames on the channel along with their radio
+	// headers rather than just the traffic of the host. Dumps are written with
+	// the interface's link type, usually radiotap. Most frames don't carry IP,
+	// so unless CatchAllKey is set, they are buffered under
+	// DefaultCatchAllKey.
+	MonitorMode bool
+
+	// CatchAllKey, if set, buffers packets that have no IP layer under this
+	// key instead of dropping them. They can then be dumped by passing the key
+	// to Dump like an IP.
+	CatchAllKey string
+
+	// RollingFileSize, if positive, switches from buffering packets in memory
+	// to writing them continuously to a pcapng file per IP on disk, which
+	// survives crashes of the process. Each file is rotated to
+	// <dir>/<ip>.1.pcapng once it reaches RollingFileSize bytes, so up to twice
+	// that much is kept per IP. Files are kept open for the NumIPs most
+	// recently active IPs and every packet is flushed as it is written. In this
+	// mode, PacketsPerIP is ignored and Dump merely flushes the current file.
+	RollingFileSize int64
+
+	// MaxOpenDumpFiles, if positive, limits the number of files that dumps keep
+	// open at once, to stay clear of file descriptor limits when many IPs are
+	// dumped concurrently. It doesn't count the files kept open by
+	// RollingFileSize.
+	MaxOpenDumpFiles int
+
+	// DumpWorkers is the number of goroutines that write dumps, which bounds
+	// the disk and CPU used by dumping however many dumps are requested at
+	// once. Further dumps queue until a worker is free. If 0,
+	// DefaultDumpWorkers is used.
+	DumpWorkers int
+
+	// IPv6PrefixLen, if set, buffers IPv6 packets by the network of that prefix
+	// length rather than by individual address, e.g. 64 to keep the traffic of
+	// hosts that rotate privacy addresses together. Keys and file names then
+	// name the network, as in <dir>/2001:db8::_64.pcapng, and dumping any
+	// address in the network dumps the whole network.
+	IPv6PrefixLen int
+
+	// IPv4PrefixLen is like IPv6PrefixLen, but for IPv4.
+	IPv4PrefixLen int
+
+	// KeyBothEndpoints, when true, keeps packets between two remote hosts under
+	// both of their IPs rather than just the destination, so that a dump of
+	// either host includes the conversation. This is useful when capturing from
+	// a tap or span port, where neither endpoint is the capturing host.
+	KeyBothEndpoints bool
+
+	// KeyByPair, when true, keeps packets under the pair of IPs of their
+	// conversation instead, so that both directions go into one buffer and are
+	// dumped to one file, <dir>/<ipA>_<ipB>.pcapng, the lower IP first. This
+	// suits capturing at a midpoint, where neither end is local. Dump and Has
+	// with an IP cover all the pairs it's part of; pass a pair as it appears in
+	// the file name to cover just that one. With SplitByDirection, packets from
+	// ipA count as outbound. It takes precedence over KeyBothEndpoints.
+	KeyByPair bool
+
+	// SplitByDirection, when true, dumps the packets received from and sent to
+	// an IP into separate files, <dir>/<ip>.in.pcapng and <dir>/<ip>.out.pcapng.
+	// When packets are captured between two remote hosts, those to the IP that
+	// they are buffered under count as outbound.
+	SplitByDirection bool
+
+	// DumpTimestampFormat, if set, has every dump go to a new file named
+	// <dir>/<ip>_<time>.pcapng instead of being appended to <dir>/<ip>.pcapng,
+	// where <time> is the time of the dump in this format, for example
+	// time.RFC3339. This keeps a history of an IP's dumps without files
+	// growing forever. Dumps of the same IP that format to the same time share
+	// a file, so choose a format precise enough for how often IPs are dumped.
+	// It has no effect on rolling files.
+	DumpTimestampFormat string
+
+	// MinDumpInterval, if positive, skips dumps of an IP requested by Dump,
+	// FlushKeep or a trigger less than this long after the IP was last dumped,
+	// so that a flapping event can't cause a storm of dumps. Skipped dumps are
+	// logged and counted in Stats.DumpsSkipped. Dumps of all or many IPs, such
+	// as by DumpAll and DumpMatching, and those by DumpNow are never skipped,
+	// but do count as the last dump of their IPs (see LastDumped).
+	MinDumpInterval time.Duration
+
+	// RecentDumps is the number of the latest dump results kept for
+	// RecentDumps(). If 0, DefaultRecentDumps is used.
+	RecentDumps int
+
+	// DumpFormat is the format of dumps. The default, DumpFormatPcapng, dumps
+	// the packets themselves. It has no effect on rolling files.
+	DumpFormat DumpFormat
+
+	// DirPerDay, when true, puts dumps into a directory per day,
+	// <dir>/YYYY-MM-DD/<ip>.pcapng, named for the local date at the time of
+	// the dump and created as needed, which keeps the directory manageable for
+	// long-running captures. An IP dumped on several days gets a file in each
+	// day's directory. It has no effect on rolling files.
+	DirPerDay bool
+
+	// RefuseExistingFiles, when true, makes a dump fail rather than append to
+	// a file that already exists, for example one left over from a previous
+	// run, so that runs are never mixed up in the same file. As a dump creates
+	// its file, each file can only be dumped to once; combine this with
+	// DumpTimestampFormat to dump an IP more than once. It has no effect on
+	// rolling files.
+	RefuseExistingFiles bool
+
+	// EncryptionKey, if set, encrypts dumps with AES-GCM under this key, which
+	// must be 16, 24 or 32 bytes long, and writes them to <dir>/<ip>.pcapng.enc
+	// instead. See Decrypt for the format. Encryption isn't supported for
+	// rolling files.
+	EncryptionKey []byte
+
+	// ChecksumFiles, when true, writes the SHA-256 checksum of every dumped
+	// file to <file>.sha256 after each dump, in the format of sha256sum, so
+	// that consumers can check that files weren't truncated or corrupted in
+	// transit. The checksum covers the file as written, so for encrypted dumps
+	// it's that of the encrypted file. New data is hashed as it is written, but
+	// appending to a file rereads it once to hash its earlier contents; set
+	// DumpTimestampFormat to avoid that. It has no effect on rolling files.
+	ChecksumFiles bool
+
+	// ResolveNames, when true, looks up the IPs in each dumped file in reverse
+	// DNS and records their names in a pcapng name resolution block at the end
+	// of the dump, which Wireshark shows in place of the IPs. Lookups are
+	// cached and are done by the dump workers, so they never hold up capture.
+	ResolveNames bool
+
+	// HostnamesInFileNames, when true, adds the name of the IP from a reverse
+	// DNS lookup to the names of dump files, as in <ip>_<hostname>.pcapng, so
+	// that the dump directory can be browsed by name. If the lookup fails or
+	// times out, the file is named by the IP alone. Lookups are cached and
+	// bounded by ResolveTimeout.
+	HostnamesInFileNames bool
+
+	// ResolveTimeout bounds the time spent on reverse lookups for a single
+	// dump; IPs that aren't resolved by then are left out. If 0,
+	// DefaultResolveTimeout is used.
+	ResolveTimeout time.Duration
+
+	// KeyByVLAN, when true, buffers packets by their 802.1Q VLAN id in addition
+	// to their IP, so that traffic from the same IP on different VLANs is kept
+	// separately. Dumps for tagged traffic go to <dir>/<ip>_vlan<id>.pcapng.
+	// For QinQ frames, the outer tag is used.
+	KeyByVLAN bool
+
+	// FakeEthernet, when true, gives packets from interfaces without a link
+	// layer, whose link type is raw IP as on many tunnels, a synthetic Ethernet
+	// header, and dumps them as Ethernet, for tools that insist on Ethernet
+	// framing. The header is made up: both MACs are all zeros and only the
+	// EtherType, IPv4 or IPv6, is real. Rules see the packets with the fake
+	// header. It has no effect on interfaces with a link layer.
+	FakeEthernet bool
+
+	// DecapsulateGTPU, when true, keys GTP-U packets, the user traffic that
+	// 4G and 5G cores tunnel between their nodes, on the IP header inside the
+	// tunnel, that of the subscriber, rather than on those of the tunnel
+	// endpoints. Dumps still contain the whole encapsulated frames. Only GTP-U
+	// on its standard UDP port, 2152, is recognized. GTP-U packets without user
+	// data, such as echo requests, are keyed on the tunnel endpoints as usual.
+	DecapsulateGTPU bool
+
+	// VLANTags normalizes the 802.1Q tags of captured Ethernet frames, which
+	// matters on VLAN sub-interfaces such as eth0.100, where the kernel may or
+	// may not hand the tag to pcap depending on its configuration and the
+	// driver's VLAN offload. The default, VLANTagsAsCaptured, leaves frames
+	// alone.
+	VLANTags VLANTagMode
+
+	// VLANID is the VLAN id that VLANTagsKeep adds to untagged frames. If 0, it
+	// is taken from the interface name, e.g. 100 for eth0.100.
+	VLANID uint16
+
+	// Rules optionally classify packets into separate sets of buffers, each
+	// dumped to its own directory. A packet is kept for every rule whose filter
+	// matches it, and it is kept in the default buffers if no rule matches.
+	// Filters are evaluated in userspace against every captured packet, so each
+	// rule adds to the cost of capture; prefer Filter for traffic that isn't
+	// wanted at all.
+	Rules []*Rule
+
+	// EtherTypes, if not empty, skips Ethernet frames of any other EtherType,
+	// such as LLDP or STP, before decoding them, which saves work on chatty
+	// segments. VLAN tags are looked through, so list the EtherType of the
+	// tagged payload, for example layers.EthernetTypeIPv4 and
+	// layers.EthernetTypeIPv6. Skipped frames are counted in
+	// Stats.PacketsFiltered. 802.3 frames, which carry a length instead of an
+	// EtherType, are skipped too. It has no effect on other link types.
+	EtherTypes []layers.EthernetType
+
+	// ExcludeLocalPorts, if not empty, skips TCP and UDP packets whose local
+	// side uses one of these ports, such as the capture host's SSH or metrics
+	// traffic, so that it doesn't crowd out the traffic of interest. Only
+	// packets to or from this host's own addresses are affected.
+	ExcludeLocalPorts []uint16
+
+	// DecodeOptions controls how captured packets are decoded. Packets read
+	// from pcap each get their own copy of the data, so NoCopy is always safe
+	// and saves a copy per packet. Lazy defers decoding layers beyond the
+	// network layer until they're used, which saves work for packets that are
+	// never dumped. Lazily decoded packets aren't safe for concurrent use, so
+	// code that receives them, like OnPacket, must not hand them on to other
+	// goroutines.
+	//
+	// Buffered packets keep the layers that were decoded for them, so dumps
+	// and flow logs read the addresses, ports and flags of the layers rather
+	// than decoding packets again. With Lazy, that holds for the layers that
+	// capture needed; the rest are decoded once, when the packet is dumped.
+	DecodeOptions gopacket.DecodeOptions
+
+	// DropMalformed, when true, drops packets that gopacket failed to decode
+	// completely, such as truncated or corrupt frames, rather than buffering
+	// them, so that garbage from noisy links doesn't push out useful packets.
+	// Dropped packets are counted in Stats.PacketsMalformed. Note that with a
+	// short SnapLen, packets that were merely cut short may fail to decode as
+	// well.
+	DropMalformed bool
+
+	// TCPFlags, if not 0, only keeps TCP packets that have at least one of
+	// these flags set, for example TCPControlFlags to follow the lifecycle of
+	// connections without buffering their data. Packets other than TCP,
+	// including fragments without a TCP header, aren't kept either.
+	TCPFlags TCPFlags
+
+	// ICMPOnly, when true, only keeps ICMP and ICMPv6 packets, so that a long
+	// history of reachability, path MTU and neighbor discovery messages fits
+	// into the buffers. Fragments after the first carry no ICMP header and are
+	// dropped too.
+	ICMPOnly bool
+
+	// MinPacketSize and MaxPacketSize, if positive, only keep IP packets whose
+	// length on the wire is at least MinPacketSize or at most MaxPacketSize
+	// bytes, for example to follow jumbo frames when debugging the MTU, or just
+	// small control packets. The length is that of the whole frame, however
+	// much of it SnapLen captures. Packets outside the range are counted in
+	// Stats.PacketsFilteredBySize.
+	MinPacketSize int
+	MaxPacketSize int
+
+	// FirstPacketPerFlow, when true, buffers only the first packet of each
+	// flow, one direction of a conversation as identified by its addresses,
+	// protocol and TCP or UDP ports, for a lightweight map of active flows
+	// rather than full traffic. Up to FlowTableSize flows, or
+	// DefaultFlowTableSize if it's 0, are remembered, the least recently seen
+	// being forgotten first, after which their next packet counts as the
+	// first again. ResetFlows forgets them all.
+	FirstPacketPerFlow bool
+	FlowTableSize      int
+
+	// OnOverflow, if set, is called with the key of a buffer, normally an IP,
+	// when the buffer is full and starts dropping its oldest packets to make
+	// room for new ones, which means that the IP's traffic outpaces
+	// PacketsPerIP and dumps won't reach as far back. It's called at most once
+	// per buffer every OverflowInterval, or DefaultOverflowInterval if that's
+	// 0. Like OnPacket, it runs on the capture goroutine and must be fast.
+	OnOverflow       func(ip string)
+	OverflowInterval time.Duration
+
+	// KeyFunc, if set, decides the keys under which a packet with destination
+	// dst and source src is buffered, replacing the heuristic of keying on the
+	// remote side. This helps behind NAT, where the local address on the wire
+	// is a private one and the interesting key is, say, the public IP that a
+	// flow was translated to. Returning no keys leaves the packet out. Keys
+	// are dumped by passing them to Dump like IPs. AllowedIPs, KeyByPair,
+	// KeyBothEndpoints and the prefix lengths don't apply to the keys that it
+	// returns. Like OnPacket, it runs on the capture goroutine and must be
+	// fast.
+	KeyFunc func(dst net.IP, src net.IP, packet gopacket.Packet) []string
+
+	// OnPacket, if set, is called with every packet that is kept in a buffer.
+	// It runs on the capture goroutine, so it must be fast and must not block,
+	// or packets will be dropped.
+	OnPacket func(packet gopacket.Packet)
+
+	// Mirror, if set, receives every kept packet as it's captured, as a pcapng
+	// stream, independently of the buffers and dumps, for live monitoring, for
+	// example over a websocket or a pipe to tshark. Packets are written from a
+	// goroutine of their own. If Mirror falls behind by more than
+	// MirrorQueueLen packets, further packets are dropped from the stream
+	// rather than holding up capture, and counted in
+	// Stats.PacketsMirrorDropped. If writing fails, mirroring stops and the
+	// error is reported on Errors. Mirror isn't closed when capture stops,
+	// unless it's an io.Closer that's still blocked writing a second after
+	// capture is asked to stop, in which case it's closed so that Stop doesn't
+	// hang.
+	Mirror io.Writer
+
+	// MirrorQueueLen is the number of packets queued for Mirror. If 0,
+	// DefaultMirrorQueueLen is used.
+	MirrorQueueLen int
+
+	// TriggerDebounce is the minimum time between dumps of the same IP caused by
+	// the same trigger (see RegisterTrigger). If 0, DefaultTriggerDebounce is
+	// used.
+	TriggerDebounce time.Duration
+
+	// MaxDuration, if positive, stops capture automatically once it has run for
+	// this long, as if Stop had been called, or Drain if DrainAfterMaxDuration
+	// is set. Errors from draining are reported on Errors.
+	MaxDuration time.Duration
+
+	// DrainAfterMaxDuration, when true, dumps all buffers when capture stops
+	// after MaxDuration.
+	DrainAfterMaxDuration bool
+
+	// Clock, if set, is used instead of the system clock for the wait for
+	// relevant packets before dumping, MaxDuration, TriggerDebounce and the
+	// times in the names and directories of dumps, so that tests can control
+	// time rather than sleep. Packet timestamps, stats and Healthy always use
+	// the system clock.
+	Clock Clock
+
+	// StatsInterval, if positive, is how often to report capture statistics,
+	// which also serves as a heartbeat showing that capture is alive. Stats are
+	// passed to OnStats if set, and logged otherwise.
+	StatsInterval time.Duration
+
+	// OnStats, if set, receives the periodic stats. Like OnPacket, it runs on
+	// the capture goroutine.
+	OnStats func(stats *Stats)
+
+	// OnStatus, if set, is called whenever the capture status changes, for
+	// example when the interface goes away and when it's reopened. Like
+	// OnPacket, it runs on the capture goroutine.
+	OnStatus func(status Status)
+}
+
+// TCPFlags is a set of TCP flags (see Opts.TCPFlags).
+type TCPFlags uint8
+
+const (
+	TCPFlagFIN TCPFlags = 1 << iota
+	TCPFlagSYN
+	TCPFlagRST
+	TCPFlagPSH
+	TCPFlagACK
+	TCPFlagURG
+	TCPFlagECE
+	TCPFlagCWR
+
+	// TCPControlFlags are the flags of the packets that open and close
+	// connections: SYN, SYN-ACK, FIN and RST.
+	TCPControlFlags = TCPFlagSYN | TCPFlagFIN | TCPFlagRST
+)
+
+// DumpFormat is the format of dumped files (see Opts.DumpFormat).
+type DumpFormat int
+
+const (
+	// DumpFormatPcapng dumps packets to <dir>/<ip>.pcapng.
+	DumpFormatPcapng DumpFormat = iota
+
+	// DumpFormatFlows dumps a compact binary log of the flows in the buffered
+	// packets to <dir>/<ip>.flows instead, with their 5-tuples, packet and
+	// byte counts and first and last timestamps but none of the packets'
+	// contents, for when full pcaps are too heavy. Packets without an IP layer
+	// are left out. ReadFlowLog reads the logs. Flow logs can't be encrypted,
+	// and ChecksumFiles, ResolveNames and SplitByDirection have no effect on
+	// them.
+	DumpFormatFlows
+)
+
+// CaptureDirection is the direction of the packets to capture (see
+// Opts.Direction).
+type CaptureDirection int
+
+const (
+	CaptureInOut CaptureDirection = iota
+	CaptureIn
+	CaptureOut
+)
+
+// VLANTagMode says what to do with the VLAN tags of captured frames (see
+// Opts.VLANTags).
+type VLANTagMode int
+
+const (
+	// VLANTagsAsCaptured stores frames as pcap hands them to us.
+	VLANTagsAsCaptured VLANTagMode = iota
+
+	// VLANTagsStrip removes the VLAN tags from tagged frames, so that dumps
+	// look like untagged traffic. For QinQ frames, all tags are removed, both
+	// outer and inner. Stripping happens before anything else looks at the
+	// frame, so KeyByVLAN and rules matching on vlan don't see the tags.
+	VLANTagsStrip
+
+	// VLANTagsKeep adds a tag with Opts.VLANID to untagged frames, so that
+	// dumps look the same whether or not the kernel kept the tag. Frames that
+	// are already tagged, including QinQ frames, are left alone.
+	VLANTagsKeep
+)
+
+// Rule routes the packets that match a filter to their own buffers and dump
+// directory (see Opts.Rules).
+type Rule struct {
+	// Name identifies the rule in stats.
+	Name string
+
+	// Filter is a BPF expression in pcap-filter(7) syntax, e.g. "port 53".
+	Filter string
+
+	// Dir is where packets matching the rule are dumped. If empty, it's the
+	// subdirectory Name of Opts.Dir.
+	Dir string
+
+	// PacketsPerIP, if positive, is the number of packets kept for each IP in
+	// the rule's buffers instead of Opts.PacketsPerIP. This allows keeping a
+	// longer history of rare but important traffic, like DNS, than of bulk
+	// traffic. Note that all buffers count against Opts.NumIPs alike.
+	PacketsPerIP int
+}
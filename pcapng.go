@@ -0,0 +1,123 @@
+package pcapper
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"github.com/google/gopacket/layers"
+)
+
+const (
+	ngBlockTypeSectionHeader        = 0x0A0D0D0A
+	ngBlockTypeInterfaceDescription = 0x00000001
+	ngByteOrderMagic                = 0x1A2B3C4D
+	ngByteOrderMagicSwapped         = 0x4D3C2B1A
+)
+
+// checkAppendable verifies that a new pcapng section can be appended to the
+// file of the given size without producing an unreadable file. pcapng allows a
+// file to contain any number of sections, so appending is safe as long as the
+// file is pcapng and ends on a block boundary. Rather than walking every block,
+// it checks that the file starts with a section header and that its final
+// block's trailing length matches its leading length, which catches files that
+// aren't pcapng and files truncated by an interrupted write.
+func checkAppendable(f io.ReaderAt, size int64) error {
+	if size == 0 {
+		return nil
+	}
+	if size < 28 {
+		return errors.New("too short to be pcapng")
+	}
+	order, _, err := readSectionHeader(f)
+	if err != nil {
+		return err
+	}
+
+	var tail [4]byte
+	if _, err := f.ReadAt(tail[:], size-4); err != nil {
+		return err
+	}
+	length := int64(order.Uint32(tail[:]))
+	if length >= 12 && length%4 == 0 && length <= size {
+		var lead [4]byte
+		if _, err := f.ReadAt(lead[:], size-length+4); err != nil {
+			return err
+		}
+		if bytes.Equal(lead[:], tail[:]) {
+			return nil
+		}
+	}
+	return errors.New("does not end on a block boundary, it may be truncated")
+}
+
+// readSectionHeader checks that f starts with a pcapng section header and
+// returns the byte order and length of that header.
+func readSectionHeader(f io.ReaderAt) (binary.ByteOrder, int64, error) {
+	var head [12]byte
+	if _, err := f.ReadAt(head[:], 0); err != nil {
+		return nil, 0, err
+	}
+	// The section header block type is a palindrome, so byte order doesn't
+	// matter here
+	if binary.LittleEndian.Uint32(head[0:4]) != ngBlockTypeSectionHeader {
+		return nil, 0, errors.New("not a pcapng file")
+	}
+	// Sections may be written in either byte order. In theory each section
+	// could differ, but in practice a file is written by one writer, so the
+	// first section's byte order stands for all of them.
+	var order binary.ByteOrder = binary.LittleEndian
+	switch binary.LittleEndian.Uint32(head[8:12]) {
+	case ngByteOrderMagic:
+	case ngByteOrderMagicSwapped:
+		order = binary.BigEndian
+	default:
+		return nil, 0, errors.New("not a pcapng file")
+	}
+	return order, int64(order.Uint32(head[4:8])), nil
+}
+
+// ngInterface is the part of a pcapng interface description that determines
+// how its packets are read.
+type ngInterface struct {
+	linkType layers.LinkType
+	snapLen  uint32
+}
+
+// readFirstInterface returns the first interface described in the pcapng file
+// of the given size, or nil if there isn't one. That's the interface of the
+// first section, which stands for the file as a whole. The file must have
+// passed checkAppendable.
+func readFirstInterface(f io.ReaderAt, size int64) (*ngInterface, error) {
+	if size == 0 {
+		return nil, nil
+	}
+	order, offset, err := readSectionHeader(f)
+	if err != nil {
+		return nil, err
+	}
+	// Writers normally put the interface right after the section header, but
+	// other blocks may come first
+	for offset+16 <= size {
+		var block [16]byte
+		if _, err := f.ReadAt(block[:], offset); err != nil {
+			return nil, err
+		}
+		blockType, length := order.Uint32(block[0:4]), int64(order.Uint32(block[4:8]))
+		switch {
+		case blockType == ngBlockTypeSectionHeader:
+			// The first section describes no interfaces
+			return nil, nil
+		case blockType == ngBlockTypeInterfaceDescription:
+			return &ngInterface{
+				linkType: layers.LinkType(order.Uint16(block[8:10])),
+				snapLen:  order.Uint32(block[12:16]),
+			}, nil
+		case length < 12 || length%4 != 0:
+			return nil, errors.New("invalid block length")
+		}
+		offset += length
+	}
+	return nil, nil
+}
@@ -1,22 +1,42 @@
 // Package pcapper provides a facility for continually capturing pcaps at the ip
 // level and then dumping those for specific IPs when the time comes.
+//
+// Packets are buffered under the IP of the remote end of their conversation.
+// When capturing on a host, one end of every conversation is one of the host's
+// own addresses, so each packet is buffered under the other end, whichever
+// direction it travels in. When capturing from a tap or mirror port, neither
+// end is local, and packets are buffered under their destination only, so a
+// dump of a host contains just the packets sent to it. Set
+// Opts.KeyBothEndpoints to buffer such packets under both ends instead.
+//
+// Dumps are written in pcapng format, always little-endian regardless of the
+// byte order of the capturing host, so files from different hosts are
+// identical in layout.
+//
+// To analyze packets live, for example with tshark, create a named pipe
+// (FIFO) where a dump or rolling file would go and have the analyzer read from
+// it. Dumps fail while nothing is reading from the pipe, and if the reader goes
+// away mid-dump, the rest of the dump is lost. Each dump starts a new pcapng
+// section, so the reader must cope with multiple sections in one stream.
+// Rolling files aren't rotated when they're pipes, and checksums aren't
+// written for them.
 package pcapper
 
 import (
-	"net"
-	"os"
-	"path/filepath"
-	"runtime"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"path"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/getlantern/golog"
-	"github.com/getlantern/ring"
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
 	"github.com/google/gopacket/pcap"
-	"github.com/google/gopacket/pcapgo"
-	"github.com/hashicorp/golang-lru"
 )
 
 var (
@@ -24,11 +44,117 @@ var (
 
 	dumpRequests    = make(chan *dumpRequest, 10000)
 	dumpAllRequests = make(chan string, 10)
+	stopRequests    = make(chan *stopRequest)
+	tasks           = make(chan func(c *capturer))
+
+	// asyncErrors holds errors for Errors until they're received.
+	asyncErrors = make(chan error, 100)
+
+	// stopped is closed once the current capture loop exits. It is nil if
+	// capturing was never started.
+	stopped   chan struct{}
+	stoppedMx sync.Mutex
+
+	// lastActivity is when the capture loop last did something, in nanoseconds
+	// since the epoch, for Healthy. Accessed atomically.
+	lastActivity int64
+
+	// startedAt is when the current capture started, in nanoseconds since the
+	// epoch, for StartedAt. Accessed atomically.
+	startedAt int64
+
+	fileLocksMutex sync.Mutex
+	fileLocks      = make(map[string]*fileLock)
 )
 
+// fileLock serializes writes to a single pcap file. refs counts the holders
+// and waiters so that the lock can be forgotten once nobody needs it.
+type fileLock struct {
+	sync.Mutex
+	refs int
+}
+
+// lockFile acquires the lock for the named file, blocking until any other
+// dump to the same file has finished. The returned function releases it.
+func lockFile(name string) func() {
+	fileLocksMutex.Lock()
+	l := fileLocks[name]
+	if l == nil {
+		l = &fileLock{}
+		fileLocks[name] = l
+	}
+	l.refs++
+	fileLocksMutex.Unlock()
+
+	l.Lock()
+	return func() {
+		l.Unlock()
+		fileLocksMutex.Lock()
+		l.refs--
+		if l.refs == 0 {
+			delete(fileLocks, name)
+		}
+		fileLocksMutex.Unlock()
+	}
+}
+
+// bufferKey identifies a buffer of packets. vlan is always 0 unless
+// Opts.KeyByVLAN is set. rule is 0 for the default buffers and otherwise one
+// more than the index of the matching rule in Opts.Rules. iface is the index
+// of the interface in capturer.sources with Opts.SeparateInterfaces, and
+// always 0 otherwise.
+type bufferKey struct {
+	ip    string
+	vlan  uint16
+	rule  int
+	iface int
+}
+
+func (k bufferKey) fileName() string {
+	return k.baseName() + ".pcapng"
+}
+
+// dumpFileName is the name of the file to which the buffer is dumped. host is
+// the name of the IP if Opts.HostnamesInFileNames is set, stamp is the
+// formatted time of the dump if Opts.DumpTimestampFormat is set and direction
+// is "in" or "out" if Opts.SplitByDirection is set. Any of them may be empty.
+func (k bufferKey) dumpFileName(host string, stamp string, direction string) string {
+	name := k.baseName()
+	if host != "" {
+		name += "_" + host
+	}
+	if stamp != "" {
+		name += "_" + strings.Replace(stamp, "/", "_", -1)
+	}
+	if direction != "" {
+		name += "." + direction
+	}
+	return name + ".pcapng"
+}
+
+func (k bufferKey) baseName() string {
+	// Keys for networks are in CIDR notation, which can't appear in file names
+	ip := strings.Replace(k.ip, "/", "_", -1)
+	if k.vlan == 0 {
+		return ip
+	}
+	return fmt.Sprintf("%v_vlan%d", ip, k.vlan)
+}
+
 type dumpRequest struct {
-	ip      string
+	ip        string
+	all       bool
+	match     bool // ip is a pattern
+	keep      bool
+	comment   string
+	requested time.Time     // by Opts.Clock, set on the capture goroutine
+	delay     time.Duration // see DumpAfter
+}
+
+type stopRequest struct {
+	dumpAll bool
 	comment string
+	result  chan error
 }
 
 // StartCapturing starts capturing packets from the named network interface. It
@@ -37,165 +163,278 @@ type dumpRequest struct {
 // <packetsPerIP> packets per IP. snapLen specifies the maximum packet length to
 // capture and timeout specifies the capture timeout.
 func StartCapturing(application string, interfaceName string, dir string, numIPs int, packetsPerIP int, snapLen int, timeout time.Duration) error {
-	ifAddrs, err := net.InterfaceAddrs()
-	if err != nil {
-		return log.Errorf("Unable to determine interface addresses: %v", err)
-	}
-	localInterfaces := make(map[string]bool, len(ifAddrs))
-	for _, ifAddr := range ifAddrs {
-		addr := strings.Split(ifAddr.String(), "/")[0] // get rid of CIDR routing prefix
-		log.Debugf("Will not save packets for local interface %v", addr)
-		localInterfaces[addr] = true
-	}
+	return StartCapturingWithOpts(&Opts{
+		Application:  application,
+		Interface:    interfaceName,
+		Dir:          dir,
+		NumIPs:       numIPs,
+		PacketsPerIP: packetsPerIP,
+		SnapLen:      snapLen,
+		Timeout:      timeout,
+	})
+}
 
-	handle, err := pcap.OpenLive(interfaceName, int32(snapLen), false, timeout)
-	if err != nil {
-		return log.Errorf("Unable to open %v for packet capture: %v", interfaceName, err)
-	}
-	packetSource := gopacket.NewPacketSource(handle, handle.LinkType())
+// StartCapturingWithOpts is like StartCapturing but takes its configuration
+// from opts.
+func StartCapturingWithOpts(opts *Opts) error {
+	return startCapturing(opts, nil)
+}
 
-	buffersByIP, err := lru.New(numIPs)
-	if err != nil {
-		return log.Errorf("Unable to initialize cache: %v", err)
-	}
+// StartCapturingWithHandle is like StartCapturing, but captures from a handle
+// that the caller has already opened and activated, configured any way
+// libpcap allows. The handle belongs to pcapper from then on and is closed
+// when capture stops, or right away if starting fails. Unlike an interface, it
+// can't be reopened, so if reading from it fails, the status becomes
+// StatusFailed, although buffered packets can still be dumped until Stop.
+//
+// As the handle doesn't tell its capture timeout, dumps wait for a second for
+// the relevant packets to be captured.
+//
+// Unlike the other functions, it has no stub on other platforms, as that would
+// make the package depend on pcap there, so callers that build for them must
+// keep it in Linux-only files.
+func StartCapturingWithHandle(h *pcap.Handle, dir string, numIPs int, packetsPerIP int) error {
+	return startCapturing(&Opts{
+		Dir:          dir,
+		NumIPs:       numIPs,
+		PacketsPerIP: packetsPerIP,
+		SnapLen:      int(h.SnapLen()),
+		Timeout:      time.Second,
+	}, h)
+}
+
+// StartCapturingFromSource is like StartCapturingWithHandle, but reads packets
+// whose link type is linkType from any source, such as one that reads framed
+// packets from a Unix domain socket fed by another process. The source belongs
+// to pcapper from then on, and if it implements io.Closer, it's closed when
+// capture stops, or right away if starting fails. Otherwise, the goroutine
+// reading from it only exits once a read returns after capture stopped. Reads
+// that fail with a temporary net.Error are retried. Any other error, including
+// io.EOF, ends capture from the source, as with a handle. There are no pcap
+// counters in Stats for such a source, and dumps record a snap length of
+// 262144, which is libpcap's default.
+func StartCapturingFromSource(src gopacket.PacketDataSource, linkType layers.LinkType, dir string, numIPs int, packetsPerIP int) error {
+	return startCapturing(&Opts{
+		Dir:          dir,
+		NumIPs:       numIPs,
+		PacketsPerIP: packetsPerIP,
+		SnapLen:      defaultSourceSnapLen,
+		Timeout:      time.Second,
+	}, &dataSource{PacketDataSource: src, linkType: linkType})
+}
 
-	getBufferByIP := func(ip string) ring.List {
-		_buffer, found := buffersByIP.Get(ip)
-		if !found {
-			_buffer = ring.NewList(packetsPerIP)
-			buffersByIP.Add(ip, _buffer)
+// startCapturing starts capturing with opts, from handle if it's not nil.
+func startCapturing(opts *Opts, handle packetSource) error {
+	stoppedMx.Lock()
+	defer stoppedMx.Unlock()
+	if stopped != nil {
+		select {
+		case <-stopped:
+			// previous capture finished, okay to start again
+		default:
+			if handle != nil {
+				handle.Close()
+			}
+			return log.Error("Already capturing, call Stop first")
 		}
-		return _buffer.(ring.List)
 	}
 
-	capturePacket := func(dstIP string, srcIP string, packet gopacket.Packet) {
-		if !localInterfaces[dstIP] {
-			getBufferByIP(dstIP).Push(packet)
-		} else if !localInterfaces[srcIP] {
-			getBufferByIP(srcIP).Push(packet)
+	c, err := newCapturer(opts, handle)
+	if err != nil {
+		if handle != nil {
+			// Closing twice is fine, in case the capturer closed it already
+			handle.Close()
 		}
+		return err
 	}
+	stopped = c.done
+	atomic.StoreInt64(&startedAt, time.Now().UnixNano())
+	c.touch()
+	go c.run()
+	return nil
+}
 
-	dumpPackets := func(ip string, comment string) error {
-		log.Debugf("Attempting to dump pcaps for %v with comment %v", ip, comment)
+// Dump dumps captured packets to/from the given ip to disk.
+//
+// Dump is safe to call from multiple goroutines and never blocks; requests are
+// queued and processed in order. Dumps that target the same file are
+// serialized, so the packets of one dump are never interleaved with another's.
+func Dump(ip string, comment string) {
+	DumpAfter(ip, comment, 0)
+}
 
-		defer func() {
-			buffersByIP.Remove(ip)
-		}()
+// DumpAfter is like Dump, but keeps buffering packets to/from ip for delay
+// before dumping them, so that the dump covers what happened after an event as
+// well as before it. Other dumps aren't held up in the meantime. Packets
+// buffered during the delay push out older ones as usual, so PacketsPerIP must
+// allow for both.
+func DumpAfter(ip string, comment string, delay time.Duration) {
+	select {
+	case dumpRequests <- &dumpRequest{ip: ip, comment: comment, delay: delay}:
+		// ok
+	default:
+		log.Errorf("Too many pending dump requests, ignoring request for %v with comment %v", ip, comment)
+	}
+}
 
-		buffers := getBufferByIP(ip)
-		if buffers.Len() == 0 {
-			log.Debugf("No pcaps to dump for %v", ip)
-			return nil
+// DumpMatching is like Dump, but dumps all IPs whose string form matches
+// pattern, using the syntax of path.Match. For example, "10.1.*" dumps every
+// IP in 10.1.0.0/16 and "2001:db8:*" every IP in 2001:db8::/32. As with
+// path.Match, * doesn't match a /, so match networks used as keys with
+// IPv4PrefixLen or IPv6PrefixLen by a pattern like "10.1.*/24". It returns an
+// error only if pattern is malformed.
+func DumpMatching(pattern string, comment string) error {
+	if _, err := path.Match(pattern, ""); err != nil {
+		return log.Errorf("Invalid pattern %v: %v", pattern, err)
+	}
+	select {
+	case dumpRequests <- &dumpRequest{ip: pattern, match: true, comment: comment}:
+		// ok
+	default:
+		log.Errorf("Too many pending dump requests, ignoring request for %v with comment %v", pattern, comment)
+	}
+	return nil
+}
+
+// DumpAllSync is like DumpAll, but blocks until everything has been dumped and
+// returns what was written for each IP, keyed by IP. The error is the first
+// one that any dump encountered. Capture continues in the meantime. When
+// capturing to rolling files, the files are flushed and there are no results.
+func DumpAllSync(comment string) (map[string]*DumpResult, error) {
+	var c *capturer
+	var jobs []*dumpJob
+	var timeout time.Duration
+	var clock Clock = realClock{}
+	onCaptureGoroutine(func(_c *capturer) {
+		timeout = _c.opts.Timeout
+		clock = _c.clock
+	})
+	// Wait a little bit to make sure we capture the relevant packets
+	<-clock.After(timeout * 2)
+	if !onCaptureGoroutine(func(_c *capturer) {
+		c = _c
+		for _, key := range c.buffersByIP.Keys() {
+			jobs = c.snapshot(jobs, key.(bufferKey), comment, false)
 		}
+		// Keeps Stop from closing dumpJobs before the jobs are queued
+		c.dispatchers.Add(1)
+	}) {
+		return nil, log.Error("Unable to dump, not capturing")
+	}
+	defer c.dispatchers.Done()
 
-		pcapsFileName := filepath.Join(dir, ip+".pcapng")
-		pcapsFile, err := os.OpenFile(pcapsFileName, os.O_APPEND|os.O_WRONLY, 0644)
-		if err != nil {
-			if !os.IsNotExist(err) {
-				return log.Errorf("Unable to open pcap file %v: %v", pcapsFileName, err)
-			}
-			pcapsFile, err = os.Create(pcapsFileName)
-			if err != nil {
-				return log.Errorf("Unable to create pcap file %v: %v", pcapsFileName, err)
-			}
+	results := make(map[string]*DumpResult)
+	var firstErr error
+	for _, result := range c.runJobs(jobs) {
+		dr := results[result.key.ip]
+		if dr == nil {
+			dr = &DumpResult{}
+			results[result.key.ip] = dr
 		}
-		intf := pcapgo.NgInterface{
-			Name:                interfaceName,
-			OS:                  runtime.GOOS,
-			SnapLength:          uint32(snapLen),
-			TimestampResolution: 9,
-		}
-		intf.LinkType = layers.LinkTypeEthernet
-		opts := pcapgo.NgWriterOptions{
-			SectionInfo: pcapgo.NgSectionInfo{
-				Hardware:    runtime.GOARCH,
-				OS:          runtime.GOOS,
-				Application: application,
-				Comment:     comment,
-			},
-		}
-		pcaps, err := pcapgo.NewNgWriterInterface(pcapsFile, intf, opts)
-		if err != nil {
-			pcapsFile.Close()
-			return log.Errorf("Error opening file %v for writing pcaps: %v", pcapsFileName, err)
-		}
-
-		dumpPacket := func(dstIP string, srcIP string, packet gopacket.Packet) {
-			if dstIP == ip || srcIP == ip {
-				ci := packet.Metadata().CaptureInfo
-				ci.InterfaceIndex = 0
-				err := pcaps.WritePacket(ci, packet.Data())
-				if err != nil {
-					log.Errorf("Error writing packet to %v: %v", pcapsFileName, err)
-				}
-			}
+		dr.add(result, c.baseDirFor(result.key))
+		if result.err != nil && firstErr == nil {
+			firstErr = result.err
 		}
+	}
+	return results, firstErr
+}
 
-		buffers.IterateForward(func(_packet interface{}) bool {
-			if _packet == nil {
-				// TODO: figure out why we need this guard condition, since we shouldn't
-				return false
+// DumpTo writes the packets buffered for ip to w as pcapng, with comment in
+// the section header, without touching the disk, for example to serve them
+// over HTTP or in memory-only mode (see Opts.InMemory). ip is interpreted as by
+// Dump, but unlike Dump, DumpTo leaves the buffers in place and writes all their
+// packets in one stream, whatever Opts.SplitByDirection says. The buffers are
+// copied on the capture goroutine and written on the calling one, so a slow w
+// doesn't hold up capture. It fails when capturing to rolling files.
+func DumpTo(w io.Writer, ip string, comment string) error {
+	var c *capturer
+	var key bufferKey
+	var packets []gopacket.Packet
+	var err error
+	if !onCaptureGoroutine(func(_c *capturer) {
+		c = _c
+		if c.rolling {
+			err = errors.New("packets are in rolling files, not buffers")
+			return
+		}
+		// A packet kept for several rules is in several buffers, but should
+		// only be written once
+		seen := make(map[gopacket.Packet]bool)
+		for _, k := range c.keysFor(ip) {
+			_buffer, found := c.buffersByIP.Peek(k)
+			if !found {
+				continue
 			}
-			packet := _packet.(gopacket.Packet)
-			nl := packet.NetworkLayer()
-			switch t := nl.(type) {
-			case *layers.IPv4:
-				dumpPacket(t.DstIP.String(), t.SrcIP.String(), packet)
-			case *layers.IPv6:
-				dumpPacket(t.DstIP.String(), t.SrcIP.String(), packet)
+			key = k
+			for _, packet := range c.copyBuffer(nil, _buffer.(*packetRing), true) {
+				if !seen[packet] {
+					seen[packet] = true
+					packets = append(packets, packet)
+				}
 			}
-			return true
-		})
-
-		flushErr := pcaps.Flush()
-		pcapsFile.Close()
-		if flushErr != nil {
-			return log.Errorf("Error flushing pcaps to %v", pcapsFileName)
 		}
-		log.Debugf("Logged pcaps for %v to %v", ip, pcapsFileName)
-		return nil
+	}) {
+		return log.Error("Unable to dump, not capturing")
+	}
+	if err != nil {
+		return log.Errorf("Unable to dump %v: %v", ip, err)
+	}
+	if err := c.writeTo(w, key, comment, packets); err != nil {
+		return log.Errorf("Unable to dump %v: %v", ip, err)
+	}
+	return nil
+}
+
+// DumpBytes is like DumpTo, but returns the pcapng data.
+func DumpBytes(ip string, comment string) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := DumpTo(&buf, ip, comment); err != nil {
+		return nil, err
 	}
+	return buf.Bytes(), nil
+}
 
-	doDumpRequests := make(chan *dumpRequest, numIPs)
-	go func() {
-		for {
-			select {
-			case packet := <-packetSource.Packets():
-				nl := packet.NetworkLayer()
-				switch t := nl.(type) {
-				case *layers.IPv4:
-					capturePacket(t.DstIP.String(), t.SrcIP.String(), packet)
-				case *layers.IPv6:
-					capturePacket(t.DstIP.String(), t.SrcIP.String(), packet)
-				}
-			case dr := <-dumpRequests:
-				// Wait a little bit to make sure we capture the relevant packets
-				time.Sleep(timeout * 2)
-				doDumpRequests <- dr
-			case dr := <-doDumpRequests:
-				dumpPackets(dr.ip, dr.comment)
-			case comment := <-dumpAllRequests:
-				// Wait a little bit to make sure we capture the relevant packets
-				time.Sleep(timeout * 2)
-				log.Debug("Dumping packets for all IP addresses")
-				for _, ip := range buffersByIP.Keys() {
-					dumpPackets(ip.(string), comment)
-				}
-			}
+// DumpNow dumps the packets buffered for ip right away and waits for the dump
+// to finish. Unlike Dump, it doesn't first wait for packets that are still on
+// their way through pcap, so use it when those have been captured already, as
+// in tests or when timing is handled upstream. It returns the error of the
+// dump, if any, which is also recorded in the result. When capturing to
+// rolling files, the files are flushed and the result is empty.
+func DumpNow(ip string, comment string) (*DumpResult, error) {
+	var c *capturer
+	var jobs []*dumpJob
+	if !onCaptureGoroutine(func(_c *capturer) {
+		c = _c
+		for _, key := range c.keysFor(ip) {
+			jobs = c.snapshot(jobs, key, comment, false)
 		}
-	}()
+		// Keeps Stop from closing dumpJobs before the jobs are queued
+		c.dispatchers.Add(1)
+	}) {
+		return nil, log.Error("Unable to dump, not capturing")
+	}
+	defer c.dispatchers.Done()
 
-	return nil
+	dr := &DumpResult{}
+	for _, result := range c.runJobs(jobs) {
+		dr.add(result, c.baseDirFor(result.key))
+	}
+	return dr, dr.Err
 }
 
-// Dump dumps captured packets to/from the given ip to disk.
-func Dump(ip string, comment string) {
+// FlushKeep is like Dump, but leaves the packets buffered, so that the buffer
+// keeps accumulating traffic and a later dump or flush includes them again.
+// This allows taking periodic snapshots of an ongoing conversation. Each flush
+// writes everything that is buffered at the time, so when appending to a file,
+// packets from earlier flushes appear again in its later sections. Set
+// Opts.DumpTimestampFormat to write each snapshot to a file of its own
+// instead. When capturing to rolling files, FlushKeep is the same as Dump.
+func FlushKeep(ip string, comment string) {
 	select {
-	case dumpRequests <- &dumpRequest{ip, comment}:
+	case dumpRequests <- &dumpRequest{ip: ip, keep: true, comment: comment}:
 		// ok
 	default:
-		log.Errorf("Too many pending dump requests, ignoring request for %v with comment %v", ip, comment)
+		log.Errorf("Too many pending dump requests, ignoring request to flush %v with comment %v", ip, comment)
 	}
 }
 
@@ -207,5 +446,373 @@ func DumpAll(comment string) {
 	default:
 		log.Errorf("Too many pending dump requests, ignoring request to dump all with comment %v", comment)
 	}
+}
+
+// Stop stops capturing and closes the capture handle. Packets that haven't been
+// dumped are discarded. Stop blocks until capturing has stopped and all the
+// goroutines that it started have exited, so that capture can be started and
+// stopped repeatedly without leaking them, and does nothing if not capturing.
+func Stop() error {
+	return stop(&stopRequest{})
+}
+
+// Drain dumps all captured packets for all ips to disk, as DumpAll does, and
+// then stops capturing, as Stop does. It returns once all files are flushed.
+// If any dump fails, the first error is returned, but capturing is stopped
+// regardless.
+func Drain(comment string) error {
+	return stop(&stopRequest{dumpAll: true, comment: comment})
+}
+
+// GetStats returns statistics about the current capture. If not capturing, it
+// returns empty Stats.
+func GetStats() *Stats {
+	stats := &Stats{}
+	onCaptureGoroutine(func(c *capturer) {
+		stats = c.stats()
+	})
+	return stats
+}
+
+// MemoryUsage estimates how many bytes the buffered packets take up, for sizing
+// Opts.NumIPs and Opts.PacketsPerIP. It's their data plus an estimate of what
+// gopacket needs to hold and decode each of them, and counts packets kept in
+// several buffers once. It returns 0 if not capturing.
+func MemoryUsage() int64 {
+	var usage int64
+	onCaptureGoroutine(func(c *capturer) {
+		usage = c.memoryUsage()
+	})
+	return usage
+}
+
+// Inject passes packets to the running capture as if they had been read from
+// the interface, blocking until all of them have been handed over. It does
+// nothing if not capturing. See SyntheticPackets.
+func Inject(packets ...gopacket.Packet) {
+	var in chan<- gopacket.Packet
+	var done chan struct{}
+	if !onCaptureGoroutine(func(c *capturer) {
+		in, done = c.packets, c.done
+	}) {
+		return
+	}
+	for _, packet := range packets {
+		select {
+		case in <- packet:
+		case <-done:
+			return
+		}
+	}
+}
+
+// SnapshotTo writes the packets in all buffers to w, so that they can be
+// restored with RestoreFrom, for example by the next process after a restart.
+// The buffers are copied on the capture goroutine, but encoded on the calling
+// one, so a slow writer doesn't hold up capture. It fails when capturing to
+// rolling files, whose packets are already on disk.
+func SnapshotTo(w io.Writer) error {
+	var snapshots []*bufferSnapshot
+	var linkType layers.LinkType
+	var err error
+	if !onCaptureGoroutine(func(c *capturer) {
+		snapshots, err = c.snapshotBuffers()
+		linkType = c.linkType
+	}) {
+		return log.Error("Unable to snapshot buffers, not capturing")
+	}
+	if err != nil {
+		return log.Errorf("Unable to snapshot buffers: %v", err)
+	}
+	if err := writeSnapshot(w, linkType, snapshots); err != nil {
+		return log.Errorf("Unable to write snapshot: %v", err)
+	}
+	return nil
+}
 
+// RestoreFrom reads a snapshot written by SnapshotTo from r and adds its
+// packets to the buffers as if they had just been captured, so NumIPs and
+// PacketsPerIP apply to them as usual. Buffers are matched up by IP, VLAN and
+// rule name; packets of rules that no longer exist go to the default buffers.
+// It fails if the snapshot was taken on a link type other than the current
+// capture's, as its packets couldn't be dumped alongside the captured ones.
+func RestoreFrom(r io.Reader) error {
+	header, snapshots, err := readSnapshot(r)
+	if err != nil {
+		return log.Errorf("Unable to read snapshot: %v", err)
+	}
+	restored := 0
+	if !onCaptureGoroutine(func(c *capturer) {
+		if c.rolling {
+			err = log.Error("Unable to restore snapshot when capturing to rolling files")
+			return
+		}
+		if header.LinkType != c.linkType {
+			err = log.Errorf("Unable to restore snapshot of link type %v when capturing %v", header.LinkType, c.linkType)
+			return
+		}
+		restored = c.restoreBuffers(header.LinkType, snapshots)
+	}) {
+		return log.Error("Unable to restore snapshot, not capturing")
+	}
+	if err != nil {
+		return err
+	}
+	log.Debugf("Restored %d packets for %d buffers", restored, len(snapshots))
+	return nil
+}
+
+// Reset discards all buffered packets, leaving capture running.
+func Reset() {
+	onCaptureGoroutine(func(c *capturer) {
+		c.buffersByIP.Purge()
+		log.Debug("Discarded all buffered packets")
+	})
+}
+
+// DisableIP stops buffering packets to/from ip, which is interpreted as by
+// Dump, while capture of other IPs carries on, for example to silence a noisy
+// host. With Opts.KeyByPair, disabling a single IP disables all of its pairs.
+// If clear is true, its buffers are discarded as well, otherwise they can
+// still be dumped. It lasts until EnableIP or the end of capture.
+func DisableIP(ip string, clear bool) {
+	onCaptureGoroutine(func(c *capturer) {
+		key := c.keyString(ip)
+		if c.disabled == nil {
+			c.disabled = make(map[string]bool)
+		}
+		c.disabled[key] = true
+		if clear && !c.rolling {
+			for _, k := range c.keysFor(ip) {
+				c.buffersByIP.Remove(k)
+			}
+		}
+		log.Debugf("Disabled buffering for %v", key)
+	})
+}
+
+// EnableIP resumes buffering packets to/from ip after DisableIP.
+func EnableIP(ip string) {
+	onCaptureGoroutine(func(c *capturer) {
+		key := c.keyString(ip)
+		if c.disabled[key] {
+			delete(c.disabled, key)
+			log.Debugf("Enabled buffering for %v", key)
+		}
+	})
+}
+
+// ResetFlows forgets the flows seen with Opts.FirstPacketPerFlow, so that the
+// next packet of each is buffered again. Buffered packets stay.
+func ResetFlows() {
+	onCaptureGoroutine(func(c *capturer) {
+		if c.flows != nil {
+			c.flows.Purge()
+			log.Debug("Forgot all flows")
+		}
+	})
+}
+
+// Has reports whether any packets to/from the given ip are buffered, which lets
+// callers skip dumps that would be empty.
+func Has(ip string) bool {
+	has := false
+	onCaptureGoroutine(func(c *capturer) {
+		has = c.has(ip)
+	})
+	return has
+}
+
+// Buffered returns the packets currently buffered, by the IP (or pair, prefix
+// or catch-all key) under which they're buffered, oldest first. It's meant for
+// tests, to check what was buffered under which key without dumping to disk.
+// Buffers of several rules, VLANs or interfaces for the same IP are appended
+// one after the other. Packets stay buffered, and must not be modified.
+// It returns nil if not capturing or when capturing to rolling files.
+func Buffered() map[string][]gopacket.Packet {
+	var buffered map[string][]gopacket.Packet
+	onCaptureGoroutine(func(c *capturer) {
+		if c.rolling {
+			return
+		}
+		buffered = make(map[string][]gopacket.Packet)
+		for _, _key := range c.buffersByIP.Keys() {
+			key := _key.(bufferKey)
+			_buffer, found := c.buffersByIP.Peek(key)
+			if !found {
+				continue
+			}
+			buffered[key.ip] = c.copyBuffer(buffered[key.ip], _buffer.(*packetRing), true)
+		}
+	})
+	return buffered
+}
+
+// RecentDumps returns the results of the latest dumps, newest first, such as
+// for listing them in a UI without scanning the directory. Up to
+// Opts.RecentDumps are kept, one for each buffer that was dumped, so a dump of
+// an IP with several rules or VLANs has several results. Dumps that wrote
+// nothing are left out. It returns nil if not capturing.
+func RecentDumps() []DumpResult {
+	var recent []DumpResult
+	onCaptureGoroutine(func(c *capturer) {
+		c.recentDumpsMx.Lock()
+		defer c.recentDumpsMx.Unlock()
+		recent = make([]DumpResult, 0, len(c.recentDumps))
+		for i := len(c.recentDumps) - 1; i >= 0; i-- {
+			recent = append(recent, *c.recentDumps[i])
+		}
+	})
+	return recent
+}
+
+// LastDumped returns when the buffers for ip were last dumped. It only
+// remembers as many IPs as Opts.NumIPs, and returns false for those it doesn't
+// remember, which includes those that were never dumped.
+func LastDumped(ip string) (time.Time, bool) {
+	var last time.Time
+	var found bool
+	onCaptureGoroutine(func(c *capturer) {
+		last, found = c.lastDumpedAt(ip)
+	})
+	return last, found
+}
+
+// GetStatus returns the current health of packet capture.
+func GetStatus() Status {
+	status := StatusStopped
+	onCaptureGoroutine(func(c *capturer) {
+		status = c.status
+	})
+	return status
+}
+
+// Healthy reports whether packet capture is running and its loop has processed
+// a packet, a request or a heartbeat within maxIdle, for use in liveness and
+// readiness probes. The loop has a heartbeat every second even when there's no
+// traffic, so maxIdle should be a few seconds at least; a capture loop that's
+// stuck, for example on a slow dump that's blocking capture, goes unhealthy.
+// Unlike the other functions here, Healthy doesn't go through the capture
+// loop, so it returns promptly even when the loop is stuck.
+func Healthy(maxIdle time.Duration) bool {
+	done := currentStopped()
+	if done == nil {
+		return false
+	}
+	select {
+	case <-done:
+		return false
+	default:
+	}
+	last := time.Unix(0, atomic.LoadInt64(&lastActivity))
+	return time.Since(last) <= maxIdle
+}
+
+// StartedAt returns when the current capture started, or the zero time if not
+// capturing. Like Healthy, it doesn't go through the capture loop.
+func StartedAt() time.Time {
+	done := currentStopped()
+	if done == nil {
+		return time.Time{}
+	}
+	select {
+	case <-done:
+		return time.Time{}
+	default:
+	}
+	return time.Unix(0, atomic.LoadInt64(&startedAt))
+}
+
+// Uptime returns how long the current capture has been running, or 0 if not
+// capturing.
+func Uptime() time.Duration {
+	started := StartedAt()
+	if started.IsZero() {
+		return 0
+	}
+	return time.Since(started)
+}
+
+// Dir returns the directory into which the current capture dumps pcaps, or ""
+// if not capturing.
+func Dir() string {
+	dir := ""
+	onCaptureGoroutine(func(c *capturer) {
+		dir = c.opts.Dir
+	})
+	return dir
+}
+
+// Interface returns the name of the interface that is being captured from, or
+// "" if not capturing. With Opts.Interfaces, it's their names joined by commas.
+func Interface() string {
+	interfaceName := ""
+	onCaptureGoroutine(func(c *capturer) {
+		interfaceName = c.interfaceNames()
+	})
+	return interfaceName
+}
+
+// Errors returns a channel on which errors that happen in the background, like
+// dumps that couldn't be written or a failing interface, are reported so that
+// callers can alert or restart capture. Errors are dropped rather than block
+// capture if nobody receives them, so receive promptly to see all of them. The
+// channel is shared by successive captures and never closed.
+func Errors() <-chan error {
+	return asyncErrors
+}
+
+// reportError passes err on to Errors without blocking and returns it.
+func reportError(err error) error {
+	select {
+	case asyncErrors <- err:
+	default:
+		// nobody's listening
+	}
+	return err
+}
+
+// onCaptureGoroutine runs fn on the capture goroutine, where it has exclusive
+// access to the capturer, and waits for it to finish. If not capturing, fn is
+// not run and onCaptureGoroutine returns false.
+func onCaptureGoroutine(fn func(c *capturer)) bool {
+	done := currentStopped()
+	if done == nil {
+		return false
+	}
+
+	finished := make(chan struct{})
+	select {
+	case tasks <- func(c *capturer) {
+		fn(c)
+		close(finished)
+	}:
+		<-finished
+		return true
+	case <-done:
+		return false
+	}
+}
+
+// currentStopped returns the channel that is closed when the current capture
+// loop exits, or nil if capturing was never started.
+func currentStopped() chan struct{} {
+	stoppedMx.Lock()
+	defer stoppedMx.Unlock()
+	return stopped
+}
+
+func stop(sr *stopRequest) error {
+	done := currentStopped()
+	if done == nil {
+		return nil
+	}
+
+	sr.result = make(chan error, 1)
+	select {
+	case stopRequests <- sr:
+		return <-sr.result
+	case <-done:
+		return nil
+	}
 }
@@ -0,0 +1,145 @@
+package pcapper
+
+import (
+	"io"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// testSource is a packet source that never yields a packet, so that tests
+// feed packets with Inject instead. Closing it ends its read.
+type testSource struct {
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func newTestSource() *testSource {
+	return &testSource{closed: make(chan struct{})}
+}
+
+func (s *testSource) ReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	<-s.closed
+	return nil, gopacket.CaptureInfo{}, io.EOF
+}
+
+func (s *testSource) Close() error {
+	s.closeOnce.Do(func() { close(s.closed) })
+	return nil
+}
+
+// startTestCapture starts capturing Ethernet frames from a testSource with
+// opts, filling in what tests don't care about, and stops again at the end of
+// the test.
+func startTestCapture(t testing.TB, opts *Opts) {
+	t.Helper()
+	startTestCaptureNoStop(t, opts)
+	t.Cleanup(func() {
+		if err := Stop(); err != nil {
+			t.Errorf("Unable to stop capturing: %v", err)
+		}
+	})
+}
+
+// startTestCaptureNoStop is startTestCapture for tests that stop capturing
+// themselves.
+func startTestCaptureNoStop(t testing.TB, opts *Opts) {
+	t.Helper()
+	if opts.Dir == "" {
+		opts.Dir = t.TempDir()
+	}
+	if opts.NumIPs == 0 {
+		opts.NumIPs = 100
+	}
+	if opts.PacketsPerIP == 0 {
+		opts.PacketsPerIP = 100
+	}
+	if opts.SnapLen == 0 {
+		opts.SnapLen = defaultSourceSnapLen
+	}
+	if opts.Timeout == 0 {
+		opts.Timeout = time.Millisecond
+	}
+	src := &dataSource{PacketDataSource: newTestSource(), linkType: layers.LinkTypeEthernet}
+	if err := startCapturing(opts, src); err != nil {
+		t.Fatalf("Unable to start capturing: %v", err)
+	}
+}
+
+func TestStartCapturingInvalidSizes(t *testing.T) {
+	tests := []struct {
+		name         string
+		numIPs       int
+		packetsPerIP int
+	}{
+		{"zero IPs", 0, 10},
+		{"negative IPs", -1, 10},
+		{"zero packets per IP", 10, 0},
+		{"negative packets per IP", 10, -1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := StartCapturing("test", "lo", t.TempDir(), test.numIPs, test.packetsPerIP, 65535, time.Millisecond)
+			if err == nil {
+				Stop()
+				t.Fatalf("expected an error for %d IPs and %d packets per IP", test.numIPs, test.packetsPerIP)
+			}
+		})
+	}
+}
+
+func TestStopLeavesNoGoroutines(t *testing.T) {
+	tests := []struct {
+		name string
+		opts func() *Opts
+	}{
+		{"plain", func() *Opts { return &Opts{} }},
+		{"stuck mirror", func() *Opts {
+			// Nothing reads from the pipe, so the mirror blocks on its first
+			// flush
+			_, w := io.Pipe()
+			return &Opts{Mirror: w}
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			before := runtime.NumGoroutine()
+			startTestCaptureNoStop(t, test.opts())
+			Inject(SyntheticPackets(100, 10)...)
+			if _, err := DumpNow("198.18.0.0", "test"); err != nil {
+				t.Fatalf("Unable to dump: %v", err)
+			}
+			stopped := make(chan error, 1)
+			go func() { stopped <- Stop() }()
+			select {
+			case err := <-stopped:
+				if err != nil {
+					t.Fatalf("Unable to stop capturing: %v", err)
+				}
+			case <-time.After(10 * time.Second):
+				t.Fatal("Stop hangs")
+			}
+			if after := runtime.NumGoroutine(); after != before {
+				buf := make([]byte, 1<<16)
+				t.Fatalf("expected %d goroutines after stopping, got %d:\n%s", before, after, buf[:runtime.Stack(buf, true)])
+			}
+		})
+	}
+}
+
+func BenchmarkCapture(b *testing.B) {
+	startTestCapture(b, &Opts{NumIPs: 1000, PacketsPerIP: 1000})
+	packets := SyntheticPackets(b.N, 1000)
+	b.ReportAllocs()
+	b.ResetTimer()
+	Inject(packets...)
+	// Inject returns once the last packet is queued, so wait for the capture
+	// goroutine to have kept them all
+	for GetStats().PacketsKept < b.N {
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -3,16 +3,180 @@
 package pcapper
 
 import (
+	"io"
 	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
 )
 
+var asyncErrors = make(chan error)
+
 // StartCapturing doesn't do anything on this platform.
 func StartCapturing(application string, interfaceName string, dir string, numIPs int, packetsPerIP int, snapLen int, timeout time.Duration) error {
 	return nil
 }
 
+// StartCapturingFromSource doesn't do anything on this platform.
+func StartCapturingFromSource(src gopacket.PacketDataSource, linkType layers.LinkType, dir string, numIPs int, packetsPerIP int) error {
+	return nil
+}
+
+// StartCapturingWithOpts doesn't do anything on this platform.
+func StartCapturingWithOpts(opts *Opts) error {
+	return nil
+}
+
 // Dump doesn't do anything on this platform.
 func Dump(ip string, comment string) {}
 
+// DumpAfter doesn't do anything on this platform.
+func DumpAfter(ip string, comment string, delay time.Duration) {}
+
+// DumpMatching doesn't do anything on this platform.
+func DumpMatching(pattern string, comment string) error {
+	return nil
+}
+
+// DumpAllSync doesn't do anything on this platform.
+func DumpAllSync(comment string) (map[string]*DumpResult, error) {
+	return nil, nil
+}
+
+// FlushKeep doesn't do anything on this platform.
+func FlushKeep(ip string, comment string) {}
+
 // DumpAll doesn't do anything on this platform.
 func DumpAll(comment string) {}
+
+// Stop doesn't do anything on this platform.
+func Stop() error {
+	return nil
+}
+
+// Drain doesn't do anything on this platform.
+func Drain(comment string) error {
+	return nil
+}
+
+// GetStats returns empty Stats on this platform.
+func GetStats() *Stats {
+	return &Stats{}
+}
+
+// Inject doesn't do anything on this platform.
+func Inject(packets ...gopacket.Packet) {}
+
+// Reset doesn't do anything on this platform.
+func Reset() {}
+
+// DisableIP doesn't do anything on this platform.
+func DisableIP(ip string, clear bool) {}
+
+// EnableIP doesn't do anything on this platform.
+func EnableIP(ip string) {}
+
+// ResetFlows doesn't do anything on this platform.
+func ResetFlows() {}
+
+// Has always returns false on this platform.
+func Has(ip string) bool {
+	return false
+}
+
+// Subscribe returns a closed channel on this platform.
+func Subscribe(ip string) (<-chan gopacket.Packet, func()) {
+	packets := make(chan gopacket.Packet)
+	close(packets)
+	return packets, func() {}
+}
+
+// MemoryUsage returns 0 on this platform.
+func MemoryUsage() int64 {
+	return 0
+}
+
+// DumpTo doesn't do anything on this platform.
+func DumpTo(w io.Writer, ip string, comment string) error {
+	return nil
+}
+
+// DumpBytes returns nothing on this platform.
+func DumpBytes(ip string, comment string) ([]byte, error) {
+	return nil, nil
+}
+
+// DumpNow doesn't do anything on this platform.
+func DumpNow(ip string, comment string) (*DumpResult, error) {
+	return &DumpResult{}, nil
+}
+
+// Buffered returns nil on this platform.
+func Buffered() map[string][]gopacket.Packet {
+	return nil
+}
+
+// RecentDumps returns nil on this platform.
+func RecentDumps() []DumpResult {
+	return nil
+}
+
+// LastDumped always returns false on this platform.
+func LastDumped(ip string) (time.Time, bool) {
+	return time.Time{}, false
+}
+
+// GetStatus always returns StatusStopped on this platform.
+func GetStatus() Status {
+	return StatusStopped
+}
+
+// Healthy always returns false on this platform.
+func Healthy(maxIdle time.Duration) bool {
+	return false
+}
+
+// StartedAt always returns the zero time on this platform.
+func StartedAt() time.Time {
+	return time.Time{}
+}
+
+// Uptime always returns 0 on this platform.
+func Uptime() time.Duration {
+	return 0
+}
+
+// Errors returns a channel on which nothing is ever sent on this platform.
+func Errors() <-chan error {
+	return asyncErrors
+}
+
+// SnapshotTo doesn't do anything on this platform.
+func SnapshotTo(w io.Writer) error {
+	return nil
+}
+
+// RestoreFrom doesn't do anything on this platform.
+func RestoreFrom(r io.Reader) error {
+	return nil
+}
+
+// Dir always returns "" on this platform.
+func Dir() string {
+	return ""
+}
+
+// Interface always returns "" on this platform.
+func Interface() string {
+	return ""
+}
+
+// ValidateInterface always succeeds on this platform.
+func ValidateInterface(name string) error {
+	return nil
+}
+
+// ListInterfaces returns no interfaces on this platform.
+func ListInterfaces() ([]*Device, error) {
+	return nil, nil
+}
@@ -0,0 +1,70 @@
+package pcapper
+
+import (
+	"context"
+	"net"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultResolveTimeout bounds the reverse lookups for a dump if
+// Opts.ResolveTimeout isn't set.
+const DefaultResolveTimeout = 2 * time.Second
+
+// maxResolvedNames bounds the cache of reverse lookups. Once it's full, it's
+// cleared, which is crude but keeps memory bounded on busy hosts.
+const maxResolvedNames = 10000
+
+// unsafeHostnameChars matches what we don't allow of a reverse lookup's answer
+// in file names. PTR records can hold just about anything.
+var unsafeHostnameChars = regexp.MustCompile(`[^A-Za-z0-9._-]`)
+
+var (
+	resolvedNames   = make(map[string]string)
+	resolvedNamesMx sync.Mutex
+)
+
+// resolveNames looks up the names of ips in reverse DNS and returns those that
+// were found, keyed by IP. Lookups are cached, including failed ones, and all
+// of them together take at most timeout, after which the remaining IPs are left
+// out.
+func resolveNames(ips []string, timeout time.Duration) map[string]string {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	names := make(map[string]string, len(ips))
+	for _, ip := range ips {
+		resolvedNamesMx.Lock()
+		name, cached := resolvedNames[ip]
+		resolvedNamesMx.Unlock()
+		if !cached {
+			if ctx.Err() != nil {
+				continue
+			}
+			addrs, err := net.DefaultResolver.LookupAddr(ctx, ip)
+			if err != nil && ctx.Err() != nil {
+				// Timed out, which says nothing about the IP, so don't cache
+				continue
+			}
+			if len(addrs) > 0 {
+				name = strings.TrimSuffix(addrs[0], ".")
+			}
+			resolvedNamesMx.Lock()
+			if len(resolvedNames) >= maxResolvedNames {
+				resolvedNames = make(map[string]string)
+			}
+			resolvedNames[ip] = name
+			resolvedNamesMx.Unlock()
+		}
+		if name != "" {
+			names[ip] = name
+		}
+	}
+	return names
+}
+
+// sanitizeHostname makes name safe for use in file names.
+func sanitizeHostname(name string) string {
+	return strings.Trim(unsafeHostnameChars.ReplaceAllString(name, "_"), ".")
+}
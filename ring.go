@@ -0,0 +1,105 @@
+package pcapper
+
+import (
+	"time"
+
+	"github.com/google/gopacket"
+)
+
+// packetRing holds up to a fixed number of the most recent packets. Once it's
+// full, each new packet replaces the oldest. Storage grows as packets arrive,
+// so buffers of quiet IPs stay small. With a window, it also drops packets
+// that are older than the window from the newest one.
+type packetRing struct {
+	packets  []gopacket.Packet
+	capacity int
+	window   time.Duration
+	oldest   int // index of the oldest packet
+	n        int // number of packets, at most len(packets)
+
+	// overflowReported is when the capturer last reported that the ring
+	// overflowed (see Opts.OnOverflow)
+	overflowReported time.Time
+}
+
+func newPacketRing(capacity int, window time.Duration) *packetRing {
+	if capacity < 1 {
+		capacity = 1
+	}
+	return &packetRing{capacity: capacity, window: window}
+}
+
+// push adds packet, reporting whether it replaced the oldest packet because
+// the ring was full.
+func (r *packetRing) push(packet gopacket.Packet) bool {
+	if r.window > 0 {
+		r.expire(packet.Metadata().Timestamp)
+	}
+	switch {
+	case r.n < len(r.packets):
+		r.packets[(r.oldest+r.n)%len(r.packets)] = packet
+		r.n++
+		return false
+	case len(r.packets) < r.capacity:
+		if r.oldest > 0 {
+			// Unwrap, so that the new packet can go at the end
+			r.packets = append(r.packets[r.oldest:], r.packets[:r.oldest]...)
+			r.oldest = 0
+		}
+		r.packets = append(r.packets, packet)
+		r.n++
+		return false
+	default:
+		r.packets[r.oldest] = packet
+		r.oldest = (r.oldest + 1) % len(r.packets)
+		return true
+	}
+}
+
+// expire drops the packets that are older than the window as of now. It does
+// nothing without a window.
+func (r *packetRing) expire(now time.Time) {
+	if r.window <= 0 {
+		return
+	}
+	cutoff := now.Add(-r.window)
+	for r.n > 0 && r.packets[r.oldest].Metadata().Timestamp.Before(cutoff) {
+		// Don't hold on to the packet until its slot is reused
+		r.packets[r.oldest] = nil
+		r.oldest = (r.oldest + 1) % len(r.packets)
+		r.n--
+	}
+}
+
+// len returns the number of packets in the ring, which is never more than the
+// number that were pushed.
+func (r *packetRing) len() int {
+	return r.n
+}
+
+// take returns the packets, oldest first, in the ring's own storage, which it
+// rotates in place rather than copying, so that handing over even a large
+// ring costs no memory. The ring must not be used afterwards.
+func (r *packetRing) take() []gopacket.Packet {
+	reverse(r.packets[:r.oldest])
+	reverse(r.packets[r.oldest:])
+	reverse(r.packets)
+	packets := r.packets[:r.n]
+	r.packets, r.oldest, r.n = nil, 0, 0
+	return packets
+}
+
+func reverse(packets []gopacket.Packet) {
+	for i, j := 0, len(packets)-1; i < j; i, j = i+1, j-1 {
+		packets[i], packets[j] = packets[j], packets[i]
+	}
+}
+
+// forEach calls fn with each packet, oldest first, until fn returns false.
+func (r *packetRing) forEach(fn func(packet gopacket.Packet) bool) {
+	for i := 0; i < r.n; i++ {
+		if !fn(r.packets[(r.oldest+i)%len(r.packets)]) {
+			return
+		}
+	}
+}
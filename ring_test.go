@@ -0,0 +1,89 @@
+package pcapper
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+)
+
+// testPacket returns a packet whose single byte and timestamp, in seconds, are
+// both seq.
+func testPacket(seq int) gopacket.Packet {
+	packet := gopacket.NewPacket([]byte{byte(seq)}, gopacket.LayerTypePayload, gopacket.Default)
+	packet.Metadata().Timestamp = time.Unix(int64(seq), 0)
+	return packet
+}
+
+// ringSeqs returns the sequence numbers of the packets in r, oldest first.
+func ringSeqs(t *testing.T, r *packetRing) []int {
+	var seqs []int
+	r.forEach(func(packet gopacket.Packet) bool {
+		if packet == nil {
+			t.Fatal("ring holds a nil packet")
+		}
+		seqs = append(seqs, int(packet.Metadata().Timestamp.Unix()))
+		return true
+	})
+	return seqs
+}
+
+func TestPacketRingOverfill(t *testing.T) {
+	r := newPacketRing(4, 0)
+	for seq := 1; seq <= 11; seq++ {
+		r.push(testPacket(seq))
+	}
+	if r.len() != 4 {
+		t.Fatalf("expected 4 packets, got %d", r.len())
+	}
+	seqs := ringSeqs(t, r)
+	want := []int{8, 9, 10, 11}
+	for i, seq := range seqs {
+		if seq != want[i] {
+			t.Fatalf("expected the newest packets %v, got %v", want, seqs)
+		}
+	}
+
+	packets := r.take()
+	if len(packets) != len(want) {
+		t.Fatalf("expected %d packets to dump, got %d", len(want), len(packets))
+	}
+	for i, packet := range packets {
+		if seq := int(packet.Metadata().Timestamp.Unix()); seq != want[i] {
+			t.Fatalf("expected packet %d to be %d, got %d", i, want[i], seq)
+		}
+		if i > 0 && packet.Metadata().Timestamp.Before(packets[i-1].Metadata().Timestamp) {
+			t.Fatalf("timestamps go backwards at packet %d", i)
+		}
+	}
+}
+
+func TestPacketRingPartial(t *testing.T) {
+	r := newPacketRing(10, 0)
+	for seq := 1; seq <= 3; seq++ {
+		r.push(testPacket(seq))
+	}
+	if r.len() != 3 {
+		t.Fatalf("expected 3 packets, got %d", r.len())
+	}
+	seqs := ringSeqs(t, r)
+	if len(seqs) != 3 {
+		t.Fatalf("expected 3 packets, got %v", seqs)
+	}
+
+	packets := r.take()
+	if len(packets) != 3 {
+		t.Fatalf("expected 3 packets to dump, got %d", len(packets))
+	}
+	for i, packet := range packets {
+		if packet == nil {
+			t.Fatalf("packet %d is nil", i)
+		}
+		if packet.Metadata().Timestamp.IsZero() || len(packet.Data()) == 0 {
+			t.Fatalf("packet %d is empty", i)
+		}
+		if seq := int(packet.Data()[0]); seq != i+1 {
+			t.Fatalf("expected packet %d to be %d, got %d", i, i+1, seq)
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package pcapper
+
+import (
+	"io"
+	"os"
+	"strings"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/pcapgo"
+)
+
+// rollingFile is a size-bounded pcapng file to which the packets for a single
+// buffer key are written continuously (see Opts.RollingFileSize). Once the file
+// reaches its maximum size, it is renamed to <name>.1.pcapng, replacing any
+// earlier one, and a new file is started.
+type rollingFile struct {
+	name          string
+	maxSize       int64
+	checkExisting func(file *os.File) (uint32, error)
+	newWriter     func(w io.Writer, snapLen uint32) (*pcapgo.NgWriter, error)
+
+	file  *os.File
+	out   *countingWriter
+	pcaps *pcapgo.NgWriter
+	fifo  bool // named pipes are streamed to and never rotated
+}
+
+// openRollingFile opens the named rolling file. checkExisting checks that the
+// file can be appended to and returns the snap length to pass to newWriter.
+func openRollingFile(name string, maxSize int64, checkExisting func(file *os.File) (uint32, error), newWriter func(w io.Writer, snapLen uint32) (*pcapgo.NgWriter, error)) (*rollingFile, error) {
+	rf := &rollingFile{
+		name:          name,
+		maxSize:       maxSize,
+		checkExisting: checkExisting,
+		newWriter:     newWriter,
+	}
+	return rf, rf.open()
+}
+
+func (rf *rollingFile) open() error {
+	var file *os.File
+	var err error
+	rf.fifo = isFIFO(rf.name)
+	if rf.fifo {
+		file, err = openFIFO(rf.name)
+		if err != nil {
+			return err
+		}
+	} else {
+		file, err = os.OpenFile(rf.name, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0644)
+		if err != nil {
+			return log.Errorf("Unable to open rolling pcap file %v: %v", rf.name, err)
+		}
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return log.Errorf("Unable to stat rolling pcap file %v: %v", rf.name, err)
+	}
+	snapLen, err := rf.checkExisting(file)
+	if err != nil {
+		// Most likely truncated by a crash while writing, or written with
+		// different options. Readers cope with either, so keep it as the
+		// previous file and start afresh.
+		log.Errorf("Not appending to rolling pcap file %v: %v", rf.name, err)
+		file.Close()
+		if err := os.Rename(rf.name, rf.previousName()); err != nil {
+			return log.Errorf("Unable to rotate rolling pcap file %v: %v", rf.name, err)
+		}
+		return rf.open()
+	}
+	out := &countingWriter{w: file, n: info.Size()}
+	// Appending starts a new pcapng section, so existing contents stay valid
+	pcaps, err := rf.newWriter(out, snapLen)
+	if err != nil {
+		file.Close()
+		return log.Errorf("Error opening rolling file %v for writing pcaps: %v", rf.name, err)
+	}
+	rf.file, rf.out, rf.pcaps = file, out, pcaps
+	return nil
+}
+
+// write writes a single packet and flushes it to the file, so that everything
+// written survives a crash of the process.
+func (rf *rollingFile) write(ci gopacket.CaptureInfo, data []byte) error {
+	if err := rf.pcaps.WritePacket(ci, data); err != nil {
+		return log.Errorf("Error writing packet to %v: %v", rf.name, describeWriteError(rf.name, err))
+	}
+	if err := rf.pcaps.Flush(); err != nil {
+		return log.Errorf("Error flushing pcaps to %v: %v", rf.name, describeWriteError(rf.name, err))
+	}
+	if rf.out.n >= rf.maxSize && !rf.fifo {
+		return rf.rotate()
+	}
+	return nil
+}
+
+func (rf *rollingFile) rotate() error {
+	if err := rf.close(); err != nil {
+		return err
+	}
+	if err := os.Rename(rf.name, rf.previousName()); err != nil {
+		return log.Errorf("Unable to rotate rolling pcap file %v: %v", rf.name, err)
+	}
+	return rf.open()
+}
+
+func (rf *rollingFile) previousName() string {
+	return strings.TrimSuffix(rf.name, ".pcapng") + ".1.pcapng"
+}
+
+func (rf *rollingFile) close() error {
+	if rf.file == nil {
+		return nil
+	}
+	flushErr := rf.pcaps.Flush()
+	closeErr := rf.file.Close()
+	rf.file, rf.out, rf.pcaps = nil, nil, nil
+	if flushErr != nil {
+		return log.Errorf("Error flushing pcaps to %v: %v", rf.name, flushErr)
+	}
+	if closeErr != nil {
+		return log.Errorf("Error closing rolling pcap file %v: %v", rf.name, closeErr)
+	}
+	return nil
+}
+
+// countingWriter counts the bytes written through it.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,148 @@
+package pcapper
+
+import (
+	"encoding/gob"
+	"errors"
+	"io"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// snapshotVersion identifies the format written by SnapshotTo.
+const snapshotVersion = 1
+
+// A snapshot is a snapshotHeader followed by a bufferSnapshot per buffer, all
+// gob encoded.
+type snapshotHeader struct {
+	Version  int
+	LinkType layers.LinkType
+}
+
+type bufferSnapshot struct {
+	IP   string
+	VLAN uint16
+	Rule string // name of the rule, empty for the default buffers
+	// Interface is the name of the interface, empty unless
+	// Opts.SeparateInterfaces is set
+	Interface string
+	Packets   []packetSnapshot
+}
+
+type packetSnapshot struct {
+	Timestamp     time.Time
+	CaptureLength int
+	Length        int
+	Data          []byte
+}
+
+// snapshotBuffers copies all buffers. It must be called on the capture
+// goroutine.
+func (c *capturer) snapshotBuffers() ([]*bufferSnapshot, error) {
+	if c.rolling {
+		return nil, errors.New("packets are in rolling files, not buffers")
+	}
+	// Oldest first, so that restoring keeps the order of recency
+	keys := c.buffersByIP.Keys()
+	snapshots := make([]*bufferSnapshot, 0, len(keys))
+	for _, _key := range keys {
+		key := _key.(bufferKey)
+		_buffer, found := c.buffersByIP.Peek(key)
+		if !found {
+			continue
+		}
+		bs := &bufferSnapshot{IP: key.ip, VLAN: key.vlan}
+		if key.rule > 0 {
+			bs.Rule = c.opts.Rules[key.rule-1].Name
+		}
+		if c.opts.SeparateInterfaces {
+			bs.Interface = c.sources[key.iface].name
+		}
+		_buffer.(*packetRing).forEach(func(packet gopacket.Packet) bool {
+			md := packet.Metadata()
+			bs.Packets = append(bs.Packets, packetSnapshot{
+				Timestamp:     md.Timestamp,
+				CaptureLength: md.CaptureLength,
+				Length:        md.Length,
+				Data:          packet.Data(),
+			})
+			return true
+		})
+		snapshots = append(snapshots, bs)
+	}
+	return snapshots, nil
+}
+
+// writeSnapshot encodes snapshots to w.
+func writeSnapshot(w io.Writer, linkType layers.LinkType, snapshots []*bufferSnapshot) error {
+	enc := gob.NewEncoder(w)
+	if err := enc.Encode(&snapshotHeader{Version: snapshotVersion, LinkType: linkType}); err != nil {
+		return err
+	}
+	for _, bs := range snapshots {
+		if err := enc.Encode(bs); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readSnapshot decodes a snapshot written by writeSnapshot from r.
+func readSnapshot(r io.Reader) (*snapshotHeader, []*bufferSnapshot, error) {
+	dec := gob.NewDecoder(r)
+	header := &snapshotHeader{}
+	if err := dec.Decode(header); err != nil {
+		return nil, nil, err
+	}
+	if header.Version != snapshotVersion {
+		return nil, nil, errors.New("unsupported snapshot version")
+	}
+	var snapshots []*bufferSnapshot
+	for {
+		bs := &bufferSnapshot{}
+		err := dec.Decode(bs)
+		if err == io.EOF {
+			return header, snapshots, nil
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		snapshots = append(snapshots, bs)
+	}
+}
+
+// restoreBuffers adds the packets in snapshots to the buffers. It must be
+// called on the capture goroutine.
+func (c *capturer) restoreBuffers(linkType layers.LinkType, snapshots []*bufferSnapshot) int {
+	rules := make(map[string]int, len(c.opts.Rules))
+	for i, rule := range c.opts.Rules {
+		rules[rule.Name] = i + 1
+	}
+	ifaces := make(map[string]int, len(c.sources))
+	if c.opts.SeparateInterfaces {
+		for _, src := range c.sources {
+			ifaces[src.name] = src.index
+		}
+	}
+	restored := 0
+	for _, bs := range snapshots {
+		// Packets of rules and interfaces that no longer exist end up in the
+		// default buffers, and so do those of all interfaces when merging them
+		key := bufferKey{ip: bs.IP, vlan: bs.VLAN, rule: rules[bs.Rule], iface: ifaces[bs.Interface]}
+		if !c.opts.KeyByVLAN {
+			key.vlan = 0
+		}
+		buffer := c.getBuffer(key)
+		for _, ps := range bs.Packets {
+			packet := gopacket.NewPacket(ps.Data, linkType, c.opts.DecodeOptions)
+			md := packet.Metadata()
+			md.Timestamp = ps.Timestamp
+			md.CaptureLength = ps.CaptureLength
+			md.Length = ps.Length
+			buffer.push(packet)
+			restored++
+		}
+	}
+	return restored
+}
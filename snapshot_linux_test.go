@@ -0,0 +1,39 @@
+package pcapper
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/google/gopacket/layers"
+)
+
+func TestRestoreFrom(t *testing.T) {
+	startTestCapture(t, &Opts{})
+	Inject(SyntheticPackets(4, 2)...)
+	var snapshot bytes.Buffer
+	if err := SnapshotTo(&snapshot); err != nil {
+		t.Fatalf("Unable to snapshot: %v", err)
+	}
+	Reset()
+	if err := RestoreFrom(bytes.NewReader(snapshot.Bytes())); err != nil {
+		t.Fatalf("Unable to restore: %v", err)
+	}
+	if buffered := Buffered(); len(buffered) != 2 || len(buffered["198.18.0.0"]) != 2 {
+		t.Fatalf("expected 2 packets for each of 2 IPs, got %v", buffered)
+	}
+}
+
+func TestRestoreFromOtherLinkType(t *testing.T) {
+	startTestCapture(t, &Opts{})
+	var snapshot bytes.Buffer
+	snapshots := []*bufferSnapshot{{IP: "198.18.0.0", Packets: []packetSnapshot{{Data: []byte{0x45}, CaptureLength: 1, Length: 1}}}}
+	if err := writeSnapshot(&snapshot, layers.LinkTypeRaw, snapshots); err != nil {
+		t.Fatalf("Unable to write snapshot: %v", err)
+	}
+	if err := RestoreFrom(&snapshot); err == nil {
+		t.Fatal("expected restoring a raw IP snapshot into an Ethernet capture to fail")
+	}
+	if buffered := Buffered(); len(buffered) != 0 {
+		t.Fatalf("expected nothing restored, got %v", buffered)
+	}
+}
@@ -0,0 +1,418 @@
+package pcapper
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+)
+
+const (
+	// minReopenBackoff and maxReopenBackoff bound the wait between attempts to
+	// reopen an interface that failed.
+	minReopenBackoff = time.Second
+	maxReopenBackoff = time.Minute
+)
+
+// defaultSourceSnapLen is the snap length recorded for packets from a
+// StartCapturingFromSource source, which doesn't tell its own.
+const defaultSourceSnapLen = 262144
+
+// packetSource is what a source reads packets from: a pcap handle, or a
+// dataSource.
+type packetSource interface {
+	gopacket.PacketDataSource
+	LinkType() layers.LinkType
+	Close()
+}
+
+// dataSource is a source passed to StartCapturingFromSource.
+type dataSource struct {
+	gopacket.PacketDataSource
+	linkType  layers.LinkType
+	closeOnce sync.Once
+}
+
+func (s *dataSource) LinkType() layers.LinkType {
+	return s.linkType
+}
+
+// closable reports whether Close closes the underlying source, which also ends
+// a read that's blocked on it.
+func (s *dataSource) closable() bool {
+	_, ok := s.PacketDataSource.(io.Closer)
+	return ok
+}
+
+// Close closes the underlying source if it can be closed. Unlike a pcap
+// handle's, it may not be safe to close twice, so only the first call does.
+func (s *dataSource) Close() {
+	closer, ok := s.PacketDataSource.(io.Closer)
+	if !ok {
+		return
+	}
+	s.closeOnce.Do(func() {
+		if err := closer.Close(); err != nil {
+			log.Debugf("Unable to close packet source: %v", err)
+		}
+	})
+}
+
+// source is an interface that packets are captured from. Apart from index,
+// name and description, which never change, its fields are only accessed from
+// the capture goroutine.
+type source struct {
+	index  int // in capturer.sources, recorded as the packets' InterfaceIndex
+	name   string
+	handle packetSource // nil while reopening
+	vlanID uint16       // added to untagged frames with VLANTagsKeep
+	// external is true for a handle or source passed to
+	// StartCapturingWithHandle or StartCapturingFromSource, which can't be
+	// reopened
+	external bool
+	// description is recorded for the interface in pcapng files (see
+	// describeInterface)
+	description string
+}
+
+// readError reports that reading from src failed.
+type readError struct {
+	src *source
+	err error
+}
+
+// reopenedSource hands a handle for src opened by reopen to the capture
+// goroutine.
+type reopenedSource struct {
+	src    *source
+	handle *pcap.Handle
+}
+
+// openSources opens a handle for every interface to capture from, which is
+// Opts.Interfaces if set and Opts.Interface otherwise, unless handle is given,
+// in which case that's the only source. On failure, the handles that were
+// already opened are closed again.
+func (c *capturer) openSources(handle packetSource) error {
+	if handle != nil {
+		c.linkType = c.storedLinkType(handle.LinkType())
+		c.sources = []*source{{name: c.opts.Interface, handle: handle, external: true, description: c.opts.InterfaceDescriptions[c.opts.Interface]}}
+		return nil
+	}
+	names := c.opts.Interfaces
+	if len(names) == 0 {
+		names = []string{c.opts.Interface}
+	}
+	for i, name := range names {
+		handle, err := openHandle(c.opts, name, c.snapLen)
+		if err == nil && i > 0 && handle.LinkType() != c.linkType {
+			handle.Close()
+			err = log.Errorf("Unable to capture from %v, its link type %v differs from the %v of %v", name, handle.LinkType(), c.linkType, names[0])
+		}
+		if err != nil {
+			c.closeSources()
+			return err
+		}
+		if i == 0 {
+			c.linkType = c.storedLinkType(handle.LinkType())
+		}
+		description, found := c.opts.InterfaceDescriptions[name]
+		if !found {
+			description = describeInterface(name)
+		}
+		c.sources = append(c.sources, &source{index: i, name: name, handle: handle, description: description})
+	}
+	return nil
+}
+
+// closeSources closes the handles of all sources.
+func (c *capturer) closeSources() {
+	for _, src := range c.sources {
+		if src.handle != nil {
+			src.handle.Close()
+			src.handle = nil
+		}
+	}
+}
+
+// interfaceNames returns the names of the interfaces captured from, joined by
+// commas.
+func (c *capturer) interfaceNames() string {
+	names := make([]string, 0, len(c.sources))
+	for _, src := range c.sources {
+		names = append(names, src.name)
+	}
+	return strings.Join(names, ",")
+}
+
+// startReading reads packets from the current handle of src on a new goroutine
+// and passes them to the capture goroutine. If reading fails, the error is
+// passed on instead and the goroutine exits.
+//
+// We don't use gopacket's PacketSource.Packets, because it retries failed reads
+// forever, so a vanished interface would go unnoticed.
+func (c *capturer) startReading(src *source) {
+	handle, linkType, index, vlanID := src.handle, src.handle.LinkType(), src.index, src.vlanID
+	fakeEthernet := c.opts.FakeEthernet && isRawIP(linkType)
+	if fakeEthernet {
+		linkType = layers.LinkTypeEthernet
+	}
+	filterEtherTypes := len(c.etherTypes) > 0 && linkType == layers.LinkTypeEthernet
+	vlanTags := c.opts.VLANTags
+	if linkType != layers.LinkTypeEthernet {
+		vlanTags = VLANTagsAsCaptured
+	}
+	// Stop waits for readers, but a read from a source that can't be closed
+	// may never return
+	tracked := true
+	if ds, ok := handle.(*dataSource); ok {
+		tracked = ds.closable()
+	}
+	if tracked {
+		c.background.Add(1)
+	}
+	go func() {
+		if tracked {
+			defer c.background.Done()
+		}
+		for {
+			data, ci, err := handle.ReadPacketData()
+			if err == nil {
+				if fakeEthernet {
+					data, ci = addFakeEthernet(data, ci)
+				}
+				if filterEtherTypes && !c.etherTypes[etherType(data)] {
+					// Skipped before decoding, which is the point
+					atomic.AddInt64(&c.packetsFiltered, 1)
+					continue
+				}
+				switch vlanTags {
+				case VLANTagsStrip:
+					data, ci = stripVLANTags(data, ci)
+				case VLANTagsKeep:
+					data, ci = addVLANTag(data, ci, vlanID)
+				}
+				ci.InterfaceIndex = index
+				// As in gopacket's PacketSource.NextPacket
+				packet := gopacket.NewPacket(data, linkType, c.opts.DecodeOptions)
+				md := packet.Metadata()
+				md.CaptureInfo = ci
+				md.Truncated = md.Truncated || ci.CaptureLength < ci.Length
+				select {
+				case c.packets <- packet:
+				case <-c.done:
+					return
+				}
+				continue
+			}
+			if isTransientReadError(err) {
+				continue
+			}
+			select {
+			case c.readErrors <- &readError{src, err}:
+			case <-c.done:
+			}
+			return
+		}
+	}()
+}
+
+// etherType returns the EtherType of an Ethernet frame, looking past any VLAN
+// tags. It returns 0 for frames too short to have one.
+func etherType(data []byte) layers.EthernetType {
+	offset := 12
+	for offset+2 <= len(data) {
+		t := layers.EthernetType(binary.BigEndian.Uint16(data[offset:]))
+		if t != layers.EthernetTypeDot1Q && t != layers.EthernetTypeQinQ {
+			return t
+		}
+		offset += 4
+	}
+	return 0
+}
+
+// isRawIP reports whether linkType carries IP packets without a link layer
+// header.
+func isRawIP(linkType layers.LinkType) bool {
+	return linkType == layers.LinkTypeRaw || linkType == layers.LinkTypeIPv4 || linkType == layers.LinkTypeIPv6
+}
+
+// storedLinkType returns the link type of the packets that we keep from an
+// interface of linkType, which differs with Opts.FakeEthernet.
+func (c *capturer) storedLinkType(linkType layers.LinkType) layers.LinkType {
+	if c.opts.FakeEthernet && isRawIP(linkType) {
+		return layers.LinkTypeEthernet
+	}
+	return linkType
+}
+
+// addFakeEthernet prepends an Ethernet header to a raw IP packet, with all-zero
+// MACs and the EtherType of the packet's IP version.
+func addFakeEthernet(data []byte, ci gopacket.CaptureInfo) ([]byte, gopacket.CaptureInfo) {
+	t := layers.EthernetTypeIPv4
+	if len(data) > 0 && data[0]>>4 == 6 {
+		t = layers.EthernetTypeIPv6
+	}
+	framed := make([]byte, 14, 14+len(data))
+	binary.BigEndian.PutUint16(framed[12:], uint16(t))
+	framed = append(framed, data...)
+	ci.CaptureLength += 14
+	ci.Length += 14
+	return framed, ci
+}
+
+// stripVLANTags removes all VLAN tags from an Ethernet frame.
+func stripVLANTags(data []byte, ci gopacket.CaptureInfo) ([]byte, gopacket.CaptureInfo) {
+	offset := 12
+	for offset+4 <= len(data) {
+		t := layers.EthernetType(binary.BigEndian.Uint16(data[offset:]))
+		if t != layers.EthernetTypeDot1Q && t != layers.EthernetTypeQinQ {
+			break
+		}
+		offset += 4
+	}
+	tags := offset - 12
+	if tags == 0 {
+		return data, ci
+	}
+	stripped := make([]byte, 0, len(data)-tags)
+	stripped = append(stripped, data[:12]...)
+	stripped = append(stripped, data[offset:]...)
+	ci.CaptureLength -= tags
+	ci.Length -= tags
+	return stripped, ci
+}
+
+// addVLANTag adds an 802.1Q tag with vlanID to an Ethernet frame, unless it's
+// already tagged.
+func addVLANTag(data []byte, ci gopacket.CaptureInfo, vlanID uint16) ([]byte, gopacket.CaptureInfo) {
+	if len(data) < 14 {
+		return data, ci
+	}
+	t := layers.EthernetType(binary.BigEndian.Uint16(data[12:]))
+	if t == layers.EthernetTypeDot1Q || t == layers.EthernetTypeQinQ {
+		return data, ci
+	}
+	tagged := make([]byte, 0, len(data)+4)
+	tagged = append(tagged, data[:12]...)
+	tagged = append(tagged, 0, 0, 0, 0)
+	binary.BigEndian.PutUint16(tagged[12:], uint16(layers.EthernetTypeDot1Q))
+	binary.BigEndian.PutUint16(tagged[14:], vlanID&0x0fff)
+	tagged = append(tagged, data[12:]...)
+	ci.CaptureLength += 4
+	ci.Length += 4
+	return tagged, ci
+}
+
+// vlanFromInterfaceName returns the VLAN id of a sub-interface named like
+// eth0.100, or 0 if the name doesn't look like one.
+func vlanFromInterfaceName(name string) uint16 {
+	dot := strings.LastIndex(name, ".")
+	if dot < 0 {
+		return 0
+	}
+	id, err := strconv.ParseUint(name[dot+1:], 10, 12)
+	if err != nil {
+		return 0
+	}
+	return uint16(id)
+}
+
+func isTransientReadError(err error) bool {
+	if err == pcap.NextErrorTimeoutExpired || err == syscall.EAGAIN {
+		return true
+	}
+	nerr, ok := err.(net.Error)
+	return ok && nerr.Temporary()
+}
+
+// readFailed closes the handle of a source after reading from it failed and
+// starts trying to reopen its interface. Buffers are left alone, so that
+// packets captured before the failure can still be dumped. Other sources carry
+// on capturing.
+func (c *capturer) readFailed(failed *readError) {
+	src := failed.src
+	reportError(log.Errorf("Capture on %v failed, will try to reopen it: %v", src.name, failed.err))
+	src.handle.Close()
+	src.handle = nil
+	if src.external {
+		reportError(log.Errorf("Unable to reopen %v, it was opened by the caller", src.name))
+		c.setStatus(StatusFailed)
+		return
+	}
+	c.setStatus(StatusReopening)
+	c.background.Add(1)
+	go c.reopen(src)
+}
+
+// reopen tries to reopen the interface of src with exponential backoff, handing
+// the new handle to the capture goroutine once it succeeds. Of src, it only
+// reads the name, which never changes.
+func (c *capturer) reopen(src *source) {
+	defer c.background.Done()
+	name := src.name
+	backoff := minReopenBackoff
+	for {
+		select {
+		case <-time.After(backoff):
+		case <-c.done:
+			return
+		}
+		handle, err := openHandle(c.opts, name, c.snapLen)
+		if err == nil {
+			// c.linkType is fixed once capture starts, as dump workers read
+			// it, and dumps of one capture can't mix link types anyway
+			if linkType := c.storedLinkType(handle.LinkType()); linkType != c.linkType {
+				handle.Close()
+				err = log.Errorf("Unable to resume capture on %v, its link type changed from %v to %v", name, c.linkType, linkType)
+			}
+		}
+		if err == nil {
+			select {
+			case c.reopened <- &reopenedSource{src, handle}:
+			case <-c.done:
+				handle.Close()
+			}
+			return
+		}
+		backoff *= 2
+		if backoff > maxReopenBackoff {
+			backoff = maxReopenBackoff
+		}
+		log.Debugf("Will try to reopen %v again in %v", name, backoff)
+	}
+}
+
+// reopenedHandle resumes capture on a handle opened by reopen.
+func (c *capturer) reopenedHandle(reopened *reopenedSource) {
+	src := reopened.src
+	src.handle = reopened.handle
+	c.startReading(src)
+	log.Debugf("Reopened %v, capturing again", src.name)
+	for _, other := range c.sources {
+		if other.handle == nil {
+			// Still waiting for another interface
+			return
+		}
+	}
+	c.setStatus(StatusCapturing)
+}
+
+func (c *capturer) setStatus(status Status) {
+	if status == c.status {
+		return
+	}
+	log.Debugf("Capture on %v is now %v", c.interfaceNames(), status)
+	c.status = status
+	if c.opts.OnStatus != nil {
+		c.opts.OnStatus(status)
+	}
+}
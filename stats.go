@@ -0,0 +1,165 @@
+package pcapper
+
+import (
+	"time"
+)
+
+// HistogramBounds are the upper bounds of the buckets of a DurationHistogram.
+var HistogramBounds = []time.Duration{
+	time.Millisecond,
+	10 * time.Millisecond,
+	100 * time.Millisecond,
+	time.Second,
+	10 * time.Second,
+}
+
+// Stats summarizes the state of packet capture.
+type Stats struct {
+	// BufferSize is the configured pcap buffer size in bytes, or 0 if pcap's
+	// default is used.
+	BufferSize int
+
+	// PacketsSeen counts the packets read from the interface.
+	PacketsSeen int
+
+	// PacketsKept counts the packets that were buffered.
+	PacketsKept int
+
+	// PacketsMalformed counts the packets that were dropped because they
+	// failed to decode (see Opts.DropMalformed).
+	PacketsMalformed int
+
+	// PacketsFiltered counts the packets that were skipped without decoding
+	// because of their EtherType (see Opts.EtherTypes).
+	PacketsFiltered int
+
+	// PacketsFilteredBySize counts the packets that were skipped because of
+	// their size (see Opts.MinPacketSize and Opts.MaxPacketSize).
+	PacketsFilteredBySize int
+
+	// PacketsMirrorDropped counts the kept packets that weren't mirrored
+	// because the mirror fell behind or failed (see Opts.Mirror).
+	PacketsMirrorDropped int
+
+	// DumpsSkipped counts the dumps that were skipped because the IP had been
+	// dumped too recently (see Opts.MinDumpInterval).
+	DumpsSkipped int
+
+	// FlowsTracked is the number of flows remembered with
+	// Opts.FirstPacketPerFlow.
+	FlowsTracked int
+
+	// PacketsReceived, PacketsDropped and PacketsIfDropped are pcap's own
+	// counters: the packets received by the filter, those dropped because the
+	// kernel buffer was full and those dropped by the interface.
+	PacketsReceived  int
+	PacketsDropped   int
+	PacketsIfDropped int
+
+	// ActiveIPs is the number of IPs for which packets are buffered.
+	ActiveIPs int
+
+	// Buffers describes the buffered packets for each IP, from most to least
+	// recently active. It is empty when capturing to rolling files.
+	Buffers []*BufferStats
+
+	// DumpWait measures how long dumps waited between being requested and
+	// being written, including the wait for relevant packets to be captured.
+	DumpWait DurationHistogram
+
+	// DumpWrite measures how long it took to write dumps, per file.
+	DumpWrite DurationHistogram
+}
+
+// BufferStats describes the packets buffered for an IP, which are what a dump
+// of the IP would contain.
+type BufferStats struct {
+	IP string
+
+	// VLAN is the VLAN id of the packets when Opts.KeyByVLAN is set.
+	VLAN uint16
+
+	// Rule is the name of the rule that the packets matched, if any (see
+	// Opts.Rules).
+	Rule string
+
+	// Interface is the name of the interface that the packets were captured
+	// on when Opts.SeparateInterfaces is set.
+	Interface string
+
+	Packets int
+
+	// FirstSeen and LastSeen are the timestamps of the oldest and newest
+	// buffered packets, so together they give the time span covered by a dump.
+	FirstSeen time.Time
+	LastSeen  time.Time
+}
+
+// DumpResult describes what a dump wrote for one IP (see DumpAllSync, DumpNow
+// and RecentDumps).
+type DumpResult struct {
+	// IP is the IP, or the network or other key, whose buffers were dumped.
+	// It's only set by RecentDumps.
+	IP string
+
+	// Time is when the dump finished. It's only set by RecentDumps.
+	Time time.Time
+
+	// Files are the files that were written to. They're under Opts.Dir, or
+	// the Dir of the rule that they're for (see Rule.Dir), so they're absolute
+	// if that is.
+	Files []string
+
+	// RelativeFiles are the same files relative to the directory that they're
+	// under, Opts.Dir or Rule.Dir, with forward slashes whatever the platform,
+	// for example to use them as object store keys. A file is left as is if
+	// its path can't be made relative, when Rule.Dir is absolute and Opts.Dir
+	// isn't or the other way round.
+	RelativeFiles []string
+
+	// Packets is the number of packets that were written.
+	Packets int
+
+	// Err is the first error encountered, if any.
+	Err error
+}
+
+// DurationHistogram summarizes a distribution of durations.
+type DurationHistogram struct {
+	Count int
+	Total time.Duration
+	Max   time.Duration
+
+	// Buckets[i] counts the durations no longer than HistogramBounds[i]. The
+	// final bucket counts the durations longer than all bounds.
+	Buckets []int
+}
+
+// Mean returns the mean duration, or 0 if nothing was observed.
+func (h *DurationHistogram) Mean() time.Duration {
+	if h.Count == 0 {
+		return 0
+	}
+	return h.Total / time.Duration(h.Count)
+}
+
+func (h *DurationHistogram) observe(d time.Duration) {
+	if h.Buckets == nil {
+		h.Buckets = make([]int, len(HistogramBounds)+1)
+	}
+	h.Count++
+	h.Total += d
+	if d > h.Max {
+		h.Max = d
+	}
+	i := 0
+	for i < len(HistogramBounds) && d > HistogramBounds[i] {
+		i++
+	}
+	h.Buckets[i]++
+}
+
+func (h DurationHistogram) copy() DurationHistogram {
+	h.Buckets = append([]int(nil), h.Buckets...)
+	return h
+}
@@ -0,0 +1,38 @@
+package pcapper
+
+// Status describes the health of packet capture.
+type Status int
+
+const (
+	// StatusStopped means that capture isn't running.
+	StatusStopped Status = iota
+
+	// StatusCapturing means that packets are being read from the interface.
+	StatusCapturing
+
+	// StatusReopening means that reading from the interface failed, for
+	// example because it went away, and capture is trying to reopen it.
+	// Buffered packets are kept and can still be dumped in the meantime.
+	StatusReopening
+
+	// StatusFailed means that reading from a handle passed to
+	// StartCapturingWithHandle failed, and since it can't be reopened, no
+	// more packets are captured from it. Buffered packets can still be dumped
+	// until capture is stopped.
+	StatusFailed
+)
+
+func (s Status) String() string {
+	switch s {
+	case StatusStopped:
+		return "stopped"
+	case StatusCapturing:
+		return "capturing"
+	case StatusReopening:
+		return "reopening"
+	case StatusFailed:
+		return "failed"
+	default:
+		return "unknown"
+	}
+}
@@ -0,0 +1,105 @@
+package pcapper
+
+import (
+	"net"
+	"sync"
+
+	"github.com/google/gopacket"
+)
+
+// subscriptionQueueLen is the number of packets queued for a subscriber before
+// further packets are dropped.
+const subscriptionQueueLen = 1000
+
+// subscription delivers the packets kept for ip to a subscriber (see
+// Subscribe).
+type subscription struct {
+	ip      string
+	packets chan gopacket.Packet
+}
+
+// Subscribe delivers the packets that are captured for ip from now on, as they
+// are kept in its buffers, until cancel is called or capture stops, at which
+// point the channel is closed. ip is interpreted as by Dump. If the subscriber
+// falls behind, packets are dropped for it rather than holding up capture. If
+// not capturing, the channel is closed immediately. With lazy decoding (see
+// Opts.DecodeOptions), subscribers receive completely decoded copies of the
+// packets, so that they're safe to use on the subscriber's goroutine.
+func Subscribe(ip string) (<-chan gopacket.Packet, func()) {
+	sub := &subscription{ip: ip, packets: make(chan gopacket.Packet, subscriptionQueueLen)}
+	if !onCaptureGoroutine(func(c *capturer) {
+		if parsed := net.ParseIP(ip); parsed != nil {
+			sub.ip = c.keyIP(parsed, ip)
+		}
+		c.subscriptions = append(c.subscriptions, sub)
+	}) {
+		close(sub.packets)
+		return sub.packets, func() {}
+	}
+	var once sync.Once
+	cancel := func() {
+		once.Do(func() {
+			onCaptureGoroutine(func(c *capturer) {
+				c.unsubscribe(sub)
+			})
+		})
+	}
+	return sub.packets, cancel
+}
+
+// publish delivers a packet kept for ips to the matching subscriptions.
+// Subscribers read packets on goroutines of their own, so lazily decoded
+// packets, which the capture goroutine may still decode further, are delivered
+// as decoded copies.
+func (c *capturer) publish(ips []string, packet gopacket.Packet) {
+	copied := false
+	for _, sub := range c.subscriptions {
+		for _, ip := range ips {
+			if !c.keyMatches(ip, sub.ip) {
+				continue
+			}
+			if c.opts.DecodeOptions.Lazy && !copied {
+				packet, copied = c.decodedCopy(packet), true
+			}
+			select {
+			case sub.packets <- packet:
+			default:
+				// Slow subscriber
+			}
+			break
+		}
+	}
+}
+
+// decodedCopy decodes the data of the lazily decoded packet again, completely,
+// into a packet of its own with the same metadata. The data is shared, as
+// neither packet modifies it.
+func (c *capturer) decodedCopy(packet gopacket.Packet) gopacket.Packet {
+	opts := c.opts.DecodeOptions
+	opts.Lazy = false
+	opts.NoCopy = true
+	decoded := gopacket.NewPacket(packet.Data(), firstLayerType(packet), opts)
+	*decoded.Metadata() = *packet.Metadata()
+	return decoded
+}
+
+// unsubscribe removes sub and closes its channel, unless capture has already
+// stopped and closed it.
+func (c *capturer) unsubscribe(sub *subscription) {
+	for i, existing := range c.subscriptions {
+		if existing == sub {
+			c.subscriptions = append(c.subscriptions[:i], c.subscriptions[i+1:]...)
+			close(sub.packets)
+			return
+		}
+	}
+}
+
+// closeSubscriptions closes the channels of all subscriptions when capture
+// stops.
+func (c *capturer) closeSubscriptions() {
+	for _, sub := range c.subscriptions {
+		close(sub.packets)
+	}
+	c.subscriptions = nil
+}
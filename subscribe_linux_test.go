@@ -0,0 +1,35 @@
+package pcapper
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+func TestSubscribeLazyGetsCopies(t *testing.T) {
+	startTestCapture(t, &Opts{DecodeOptions: gopacket.DecodeOptions{Lazy: true, NoCopy: true}})
+	packets, cancel := Subscribe("198.18.0.0")
+	defer cancel()
+
+	synthetic := SyntheticPackets(1, 1)[0]
+	packet := gopacket.NewPacket(synthetic.Data(), layers.LayerTypeEthernet, gopacket.DecodeOptions{Lazy: true, NoCopy: true})
+	*packet.Metadata() = *synthetic.Metadata()
+	Inject(packet)
+
+	select {
+	case received := <-packets:
+		if received == packet {
+			t.Fatal("expected a copy of the lazily decoded packet")
+		}
+		if received.Layer(layers.LayerTypeUDP) == nil {
+			t.Fatal("expected the copy to be decoded completely")
+		}
+		if !received.Metadata().Timestamp.Equal(packet.Metadata().Timestamp) {
+			t.Fatalf("expected the copy to have timestamp %v, got %v", packet.Metadata().Timestamp, received.Metadata().Timestamp)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no packet delivered")
+	}
+}
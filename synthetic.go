@@ -0,0 +1,82 @@
+package pcapper
+
+import (
+	"encoding/binary"
+	"net"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+var (
+	syntheticMAC     = net.HardwareAddr{0x02, 0x00, 0x00, 0x00, 0x00, 0x01}
+	syntheticSrcIPv4 = net.IP{198, 51, 100, 1}
+	syntheticSrcIPv6 = net.ParseIP("2001:db8:ffff::1")
+)
+
+// SyntheticPackets generates numPackets UDP packets sent to numIPs different
+// IPs in turn, alternating between IPv4 and IPv6 IPs. Together with Inject, it
+// allows exercising buffering and dumping without a network interface, for
+// example to benchmark them. The IPs come from ranges reserved for
+// benchmarking and documentation (198.18.0.0/15 and 2001:db8::/32), for up
+// to 131072 IPs, and the packets are sent from 198.51.100.1 and
+// 2001:db8:ffff::1, outside them. The packets are timestamped a microsecond
+// apart, ending now.
+func SyntheticPackets(numPackets int, numIPs int) []gopacket.Packet {
+	if numIPs < 1 {
+		numIPs = 1
+	}
+	payload := gopacket.Payload(make([]byte, 64))
+	start := time.Now().Add(-time.Duration(numPackets) * time.Microsecond)
+	packets := make([]gopacket.Packet, 0, numPackets)
+	buf := gopacket.NewSerializeBuffer()
+	serializeOpts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	for i := 0; i < numPackets; i++ {
+		n := i % numIPs
+		eth := &layers.Ethernet{SrcMAC: syntheticMAC, DstMAC: syntheticMAC}
+		udp := &layers.UDP{SrcPort: layers.UDPPort(10000 + n%50000), DstPort: 53}
+		var network gopacket.SerializableLayer
+		if n%2 == 0 {
+			eth.EthernetType = layers.EthernetTypeIPv4
+			dst := make(net.IP, net.IPv4len)
+			binary.BigEndian.PutUint32(dst, (198<<24|18<<16)+uint32(n))
+			ip := &layers.IPv4{
+				Version:  4,
+				TTL:      64,
+				Protocol: layers.IPProtocolUDP,
+				SrcIP:    syntheticSrcIPv4,
+				DstIP:    dst,
+			}
+			udp.SetNetworkLayerForChecksum(ip)
+			network = ip
+		} else {
+			eth.EthernetType = layers.EthernetTypeIPv6
+			dst := make(net.IP, net.IPv6len)
+			copy(dst, net.ParseIP("2001:db8::"))
+			dst[12], dst[13], dst[14], dst[15] = byte(n>>24), byte(n>>16), byte(n>>8), byte(n)
+			ip := &layers.IPv6{
+				Version:    6,
+				HopLimit:   64,
+				NextHeader: layers.IPProtocolUDP,
+				SrcIP:      syntheticSrcIPv6,
+				DstIP:      dst,
+			}
+			udp.SetNetworkLayerForChecksum(ip)
+			network = ip
+		}
+		if err := gopacket.SerializeLayers(buf, serializeOpts, eth, network, udp, payload); err != nil {
+			// Can't happen with the layers above
+			panic(err)
+		}
+		data := make([]byte, len(buf.Bytes()))
+		copy(data, buf.Bytes())
+		packet := gopacket.NewPacket(data, layers.LayerTypeEthernet, gopacket.Default)
+		md := packet.Metadata()
+		md.Timestamp = start.Add(time.Duration(i) * time.Microsecond)
+		md.CaptureLength = len(data)
+		md.Length = len(data)
+		packets = append(packets, packet)
+	}
+	return packets
+}
@@ -0,0 +1,34 @@
+package pcapper
+
+import (
+	"net"
+	"testing"
+
+	"github.com/google/gopacket/layers"
+)
+
+func TestSyntheticPacketsDistinctIPs(t *testing.T) {
+	_, benchmarking, _ := net.ParseCIDR("198.18.0.0/15")
+	// All of 198.18.0.0/15, which takes more than two octets of the index
+	const numIPs = 1 << 17
+	seen := make(map[string]bool, numIPs)
+	for _, packet := range SyntheticPackets(numIPs, numIPs) {
+		var dst, src string
+		switch ip := packet.NetworkLayer().(type) {
+		case *layers.IPv4:
+			if !benchmarking.Contains(ip.DstIP) {
+				t.Fatalf("IP %v is outside %v", ip.DstIP, benchmarking)
+			}
+			dst, src = ip.DstIP.String(), ip.SrcIP.String()
+		case *layers.IPv6:
+			dst, src = ip.DstIP.String(), ip.SrcIP.String()
+		}
+		if dst == src {
+			t.Fatalf("IP %v generated as the source as well", dst)
+		}
+		if seen[dst] {
+			t.Fatalf("IP %v generated twice", dst)
+		}
+		seen[dst] = true
+	}
+}
@@ -0,0 +1,86 @@
+package pcapper
+
+import (
+	"sync"
+	"time"
+
+	"github.com/google/gopacket"
+)
+
+// DefaultTriggerDebounce is used when Opts.TriggerDebounce is 0.
+const DefaultTriggerDebounce = 30 * time.Second
+
+var (
+	triggers   []*trigger
+	triggersMx sync.RWMutex
+)
+
+type trigger struct {
+	predicate func(gopacket.Packet) bool
+	comment   string
+	after     time.Duration
+	// lastFired tracks when the trigger last fired for each IP. It is only
+	// accessed from the capture goroutine.
+	lastFired map[string]time.Time
+}
+
+// RegisterTrigger registers a predicate that is evaluated against every packet
+// that is kept. When it matches, a dump of the packet's IP is requested as if
+// by Dump(ip, comment), capturing the context leading up to the matching
+// packet. To avoid a burst of matching packets producing a burst of dumps, a
+// trigger fires at most once per IP every Opts.TriggerDebounce.
+//
+// Like Opts.OnPacket, predicate runs on the capture goroutine and must be fast.
+// Triggers may be registered before or during capture and stay registered for
+// the life of the process.
+func RegisterTrigger(predicate func(gopacket.Packet) bool, comment string) {
+	RegisterTriggerAfter(predicate, comment, 0)
+}
+
+// RegisterTriggerAfter is like RegisterTrigger, but keeps buffering the IP's
+// packets for after the matching packet before dumping them, as by DumpAfter,
+// so that the dump covers a window around the event rather than only what led
+// up to it. Opts.TriggerDebounce should be longer than after, so that packets
+// matching during the window don't request more dumps.
+func RegisterTriggerAfter(predicate func(gopacket.Packet) bool, comment string, after time.Duration) {
+	triggersMx.Lock()
+	triggers = append(triggers, &trigger{
+		predicate: predicate,
+		comment:   comment,
+		after:     after,
+		lastFired: make(map[string]time.Time),
+	})
+	triggersMx.Unlock()
+}
+
+// fireTriggers evaluates all registered triggers against a packet that was
+// kept for ips at time now. Each predicate runs once per packet, and a trigger
+// that matches requests a dump of each of the ips.
+func fireTriggers(ips []string, packet gopacket.Packet, now time.Time, debounce time.Duration) {
+	triggersMx.RLock()
+	// Triggers are only ever appended, so the registered ones stay as they are
+	// in this copy
+	current := triggers
+	triggersMx.RUnlock()
+	// Called without holding the lock, so that predicates may register
+	// triggers
+	for _, t := range current {
+		if !t.predicate(packet) {
+			continue
+		}
+		// Forget IPs whose debounce has expired so lastFired stays small
+		for firedIP, firedAt := range t.lastFired {
+			if now.Sub(firedAt) >= debounce {
+				delete(t.lastFired, firedIP)
+			}
+		}
+		for _, ip := range ips {
+			if _, fired := t.lastFired[ip]; fired {
+				// Within the debounce of the last dump
+				continue
+			}
+			t.lastFired[ip] = now
+			DumpAfter(ip, t.comment, t.after)
+		}
+	}
+}
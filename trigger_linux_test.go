@@ -0,0 +1,71 @@
+package pcapper
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+)
+
+// resetTriggers unregisters the triggers that a test registers once it's done,
+// as they'd otherwise stay registered for the tests that follow.
+func resetTriggers(t *testing.T) {
+	triggersMx.RLock()
+	registered := len(triggers)
+	triggersMx.RUnlock()
+	t.Cleanup(func() {
+		triggersMx.Lock()
+		// Limiting the capacity keeps later triggers from overwriting the ones
+		// of copies taken by fireTriggers
+		triggers = triggers[:registered:registered]
+		triggersMx.Unlock()
+	})
+}
+
+func TestTriggerRegistersTrigger(t *testing.T) {
+	resetTriggers(t)
+	startTestCapture(t, &Opts{})
+	registered := false
+	RegisterTrigger(func(packet gopacket.Packet) bool {
+		if !registered {
+			registered = true
+			RegisterTrigger(func(gopacket.Packet) bool { return false }, "never")
+		}
+		return false
+	}, "registers")
+	done := make(chan struct{})
+	go func() {
+		Inject(SyntheticPackets(2, 1)...)
+		// Only returns once the capture goroutine got past the packets
+		GetStats()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("capture deadlocked when a predicate registered a trigger")
+	}
+	if !registered {
+		t.Fatal("predicate didn't run")
+	}
+}
+
+func TestTriggerOncePerPacket(t *testing.T) {
+	resetTriggers(t)
+	startTestCapture(t, &Opts{KeyBothEndpoints: true})
+	calls := 0
+	RegisterTrigger(func(gopacket.Packet) bool {
+		calls++
+		return true
+	}, "both")
+	Inject(SyntheticPackets(1, 1)...)
+	dst, src := "198.18.0.0", syntheticSrcIPv4.String()
+	waitFor(t, "dumps of both endpoints", func() bool {
+		_, dstDumped := LastDumped(dst)
+		_, srcDumped := LastDumped(src)
+		return dstDumped && srcDumped
+	})
+	if calls != 1 {
+		t.Fatalf("expected the predicate to run once for the packet, ran %d times", calls)
+	}
+}